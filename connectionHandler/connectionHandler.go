@@ -6,37 +6,92 @@ import (
 	"github.com/couchbaselabs/go-couchbase"
 	"github.com/streadway/amqp"
 	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 	//"database/sql"
 	//_ "github.com/go-sql-driver/mysql"
 )
 
-var couchbaseURI = flag.String("couchbase", "http://localhost:8091/", "couchbase URI")
+var (
+	couchbaseURI  = flag.String("couchbase", "http://localhost:8091/", "couchbase URI")
+	prefetchCount = flag.Int("prefetch", 16, "number of unacknowledged deliveries the broker sends ahead")
+	reconnectWait = flag.Duration("reconnectWait", 30*time.Second, "longest wait between attempts to reconnect to rabbitmq")
+	drainTimeout  = flag.Duration("drainTimeout", 30*time.Second, "how long shutdown waits for in-flight requests")
+)
+
+type ConnectionState int32
+
+const (
+	Connecting ConnectionState = iota
+	Connected
+	Reconnecting
+	Closed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+
+	return fmt.Sprintf("ConnectionState(%d)", int32(s))
+}
 
 type RabbitmqConsumer struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	done    chan error
+	amqpURI     string
+	queueName   string
+	consumerTag string
+
+	//conn and the channels are replaced on every reconnect
+	lock           sync.RWMutex
+	conn           *amqp.Connection
+	channel        *amqp.Channel
+	publishChannel *amqp.Channel
+	state          int32
+
+	//deliveries outlives the amqp channels and is what the handler consumes
+	deliveries chan amqp.Delivery
+	closing    chan struct{}
+	closeOnce  sync.Once
+	done       chan error
+
+	//closed once the handler returned, handlerErr is what it sent on done
+	finished   chan struct{}
+	handlerErr error
 }
 
-type rabbitmqHandler func(deliveries <-chan amqp.Delivery, done chan error)
+type rabbitmqHandler func(consumer *RabbitmqConsumer, deliveries <-chan amqp.Delivery, done chan error)
 
+//Couch keeps one couchbase connection and a handle per bucket for the process lifetime
+//it is safe for concurrent use, buckets must not be closed by their users
 type Couch struct {
 	conn *couchbase.Client
 	pool *couchbase.Pool
+
+	lock    sync.Mutex
+	buckets map[string]*couchbase.Bucket
 }
 
-func CreateCouchbaseConn(address string) (Couch, error) {
-	couchConn := Couch{}
+func CreateCouchbaseConn(address string) (*Couch, error) {
+	couchConn := &Couch{buckets: make(map[string]*couchbase.Bucket)}
 
 	log.Printf("connecting to %q for couchbase", address)
 	conn, err := couchbase.Connect(address)
 	if err != nil {
-		return Couch{}, fmt.Errorf("Error getting connection: %s", err)
+		return nil, fmt.Errorf("Error getting connection: %s", err)
 	}
 
 	pool, err := conn.GetPool("default")
 	if err != nil {
-		return Couch{}, fmt.Errorf("Error getting pool:  %s", err)
+		return nil, fmt.Errorf("Error getting pool:  %s", err)
 	}
 
 	couchConn.conn = &conn
@@ -45,92 +100,329 @@ func CreateCouchbaseConn(address string) (Couch, error) {
 	return couchConn, nil
 }
 
-//defer bucket.Close()
-func GetBucket(bucketname string) (*couchbase.Bucket, error) {
-	conn, err := couchbase.Connect(*couchbaseURI)
-	if err != nil {
-		//log.Println("Make sure that couchbase is at", couchbaseURI)
-		return nil, fmt.Errorf("Error getting connection: %s", err)
+func (c *Couch) GetBucket(bucketname string) (Bucket, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if bucket, exist := c.buckets[bucketname]; exist {
+		return couchbaseBucket{bucket}, nil
 	}
 
-	pool, err := conn.GetPool("default")
+	bucket, err := c.pool.GetBucket(bucketname)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting pool:  %s", err)
+		return nil, fmt.Errorf("Failed to get bucket from couchbase (%s)", err)
 	}
 
-	bucket, err := pool.GetBucket(bucketname)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get bucket from couchbase (%s)\n", err)
+	c.buckets[bucketname] = bucket
+
+	return couchbaseBucket{bucket}, nil
+}
+
+func (c *Couch) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for bucketname, bucket := range c.buckets {
+		bucket.Close()
+		delete(c.buckets, bucketname)
 	}
+}
+
+var (
+	sharedCouchLock sync.Mutex
+	sharedCouch     *Couch
+)
 
-	return bucket, nil
+//connection used by GetBucket, created on first use so a failed connect is retried by the next call
+func sharedCouchConn() (*Couch, error) {
+	sharedCouchLock.Lock()
+	defer sharedCouchLock.Unlock()
+
+	if sharedCouch == nil {
+		couchConn, err := CreateCouchbaseConn(*couchbaseURI)
+		if err != nil {
+			return nil, err
+		}
+		sharedCouch = couchConn
+	}
+
+	return sharedCouch, nil
+}
+
+//CloseCouchbase closes every bucket opened by GetBucket
+func CloseCouchbase() {
+	sharedCouchLock.Lock()
+	defer sharedCouchLock.Unlock()
+
+	if sharedCouch != nil {
+		sharedCouch.Close()
+		sharedCouch = nil
+	}
 }
 
-//must run go deliverHandle(deliveries, c.done) after this function
+//deliverFunc runs until the consumer is shut down, reconnects are invisible to it
 func CreateRabbitmqConsumer(amqpURI, queueName string, deliverFunc rabbitmqHandler) (*RabbitmqConsumer, error) {
 	c := &RabbitmqConsumer{
-		conn:    nil,
-		channel: nil,
-		done:    make(chan error),
+		amqpURI:     amqpURI,
+		queueName:   queueName,
+		consumerTag: fmt.Sprintf("go-worker-%d", os.Getpid()),
+		deliveries:  make(chan amqp.Delivery),
+		closing:     make(chan struct{}),
+		done:        make(chan error),
+		finished:    make(chan struct{}),
+	}
+
+	c.setState(Connecting)
+	deliveries, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.forward(deliveries)
+	go deliverFunc(c, c.deliveries, c.done)
+	go func() {
+		c.handlerErr = <-c.done
+		close(c.finished)
+	}()
+
+	return c, nil
+}
+
+//State returns the current state of the rabbitmq connection
+func (c *RabbitmqConsumer) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+func (c *RabbitmqConsumer) setState(state ConnectionState) {
+	old := ConnectionState(atomic.SwapInt32(&c.state, int32(state)))
+	if old != state {
+		log.Printf("rabbitmq connection state : %s -> %s", old, state)
+	}
+}
+
+func (c *RabbitmqConsumer) currentChannel() *amqp.Channel {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.channel
+}
+
+func (c *RabbitmqConsumer) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
 	}
-	var err error
+}
 
-	log.Printf("dialing %q", amqpURI)
-	c.conn, err = amqp.Dial(amqpURI)
+//connect dials rabbitmq, declares every queue and starts consuming
+func (c *RabbitmqConsumer) connect() (<-chan amqp.Delivery, error) {
+	log.Printf("dialing %q", c.amqpURI)
+	conn, err := amqp.Dial(c.amqpURI)
 	if err != nil {
 		return nil, fmt.Errorf("Dial: %s", err)
 	}
 
 	go func() {
-		fmt.Printf("closing: %s", <-c.conn.NotifyClose(make(chan *amqp.Error)))
+		if err, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1)); ok {
+			log.Printf("closing: %s", err)
+		}
+	}()
+
+	channel, deliveries, err := c.consume(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//publishing has its own channel so a failed publish cannot close the consuming one
+	publishChannel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Publish Channel: %s", err)
+	}
+
+	//without a publish channel nothing can be settled, start over with a new connection
+	go func() {
+		if err, ok := <-publishChannel.NotifyClose(make(chan *amqp.Error, 1)); ok {
+			log.Printf("publish channel closing: %s", err)
+			conn.Close()
+		}
 	}()
 
+	c.lock.Lock()
+	c.conn = conn
+	c.channel = channel
+	c.publishChannel = publishChannel
+	c.lock.Unlock()
+
+	c.setState(Connected)
+
+	return deliveries, nil
+}
+
+func (c *RabbitmqConsumer) consume(conn *amqp.Connection) (*amqp.Channel, <-chan amqp.Delivery, error) {
 	log.Printf("got Connection, getting Channel")
-	c.channel, err = c.conn.Channel()
+	channel, err := conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("Channel: %s", err)
+		return nil, nil, fmt.Errorf("Channel: %s", err)
 	}
 
-	queue, err := c.channel.QueueDeclare(
-		queueName, // name of the queue
-		true,      // durable
-		false,     // delete when usused
-		false,     // exclusive
-		false,     // noWait
-		nil,       // arguments
+	//bound the in-flight window, otherwise the broker pushes the whole queue to us
+	err = channel.Qos(
+		*prefetchCount, // prefetchCount
+		0,              // prefetchSize
+		false,          // global
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Queue Declare: %s", err)
+		return nil, nil, fmt.Errorf("Channel Qos: %s", err)
+	}
+
+	queue, err := channel.QueueDeclare(
+		c.queueName, // name of the queue
+		true,        // durable
+		false,       // delete when usused
+		false,       // exclusive
+		false,       // noWait
+		nil,         // arguments
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Queue Declare: %s", err)
 	}
 
 	log.Printf("declared Queue : %q ", queue.Name)
 
-	deliveries, err := c.channel.Consume(
-		queue.Name, // name
-		"",         // consumerTag,
-		false,      // noAck
-		false,      // exclusive
-		false,      // noLocal
-		false,      // noWait
-		nil,        // arguments
+	err = declareDeadLetter(channel, queue.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = declareRetryQueues(channel, queue.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries, err := channel.Consume(
+		queue.Name,    // name
+		c.consumerTag, // consumerTag,
+		false,         // noAck
+		false,         // exclusive
+		false,         // noLocal
+		false,         // noWait
+		nil,           // arguments
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Queue Consume: %s", err)
+		return nil, nil, fmt.Errorf("Queue Consume: %s", err)
 	}
 
-	go deliverFunc(deliveries, c.done)
+	return channel, deliveries, nil
+}
 
-	return c, nil
+//forward copies deliveries to c.deliveries and reconnects whenever the amqp channel closes
+func (c *RabbitmqConsumer) forward(deliveries <-chan amqp.Delivery) {
+	for deliveries != nil {
+		for d := range deliveries {
+			c.deliveries <- d
+		}
+
+		if c.isClosing() {
+			break
+		}
+
+		log.Printf("rabbitmq deliveries channel closed, reconnecting")
+		c.setState(Reconnecting)
+		deliveries = c.reconnect()
+	}
+
+	c.setState(Closed)
+	close(c.deliveries)
+}
+
+//reconnect retries connect with exponential backoff, it returns nil once the consumer is shutting down
+func (c *RabbitmqConsumer) reconnect() <-chan amqp.Delivery {
+	wait := time.Second
+	for {
+		//the channel may be gone while the connection is still open
+		c.lock.RLock()
+		c.conn.Close()
+		c.lock.RUnlock()
+
+		deliveries, err := c.connect()
+		if err == nil {
+			//shut down while dialing
+			if c.isClosing() {
+				c.lock.RLock()
+				c.conn.Close()
+				c.lock.RUnlock()
+				return nil
+			}
+			return deliveries
+		}
+
+		log.Printf("reconnect failed, retrying in %s: %s", wait, err)
+
+		select {
+		case <-c.closing:
+			return nil
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > *reconnectWait {
+			wait = *reconnectWait
+		}
+	}
+}
+
+//StopConsuming cancels the consumer, deliveries already received are still passed to the handler
+//the deliveries channel of the handler is closed once they are, and no reconnect happens afterwards
+func (c *RabbitmqConsumer) StopConsuming() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+
+	if c.State() != Connected {
+		return nil
+	}
+
+	if err := c.currentChannel().Cancel(c.consumerTag, false); err != nil && err != amqp.ErrClosed {
+		return fmt.Errorf("Consumer Cancel: %s", err)
+	}
+
+	return nil
+}
+
+//Drain stops consuming and waits up to -drainTimeout for the handler to settle in-flight deliveries
+func (c *RabbitmqConsumer) Drain() error {
+	if err := c.StopConsuming(); err != nil {
+		log.Printf("%s", err)
+	}
+
+	return c.waitHandler()
+}
+
+func (c *RabbitmqConsumer) waitHandler() error {
+	select {
+	case <-c.finished:
+		return c.handlerErr
+	case <-time.After(*drainTimeout):
+		return fmt.Errorf("handler still running after %s", *drainTimeout)
+	}
 }
 
 func (c *RabbitmqConsumer) RabbitmqShutdown() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+
 	// will close() the deliveries channel
-	if err := c.conn.Close(); err != nil {
+	if err := conn.Close(); err != nil && err != amqp.ErrClosed {
 		return fmt.Errorf("AMQP connection close error: %s", err)
 	}
 
 	defer log.Printf("AMQP shutdown OK")
 
 	// wait for handle() to exit
-	return <-c.done
+	return c.waitHandler()
 }
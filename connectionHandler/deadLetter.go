@@ -0,0 +1,108 @@
+package connectionHandler
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"log"
+	"time"
+)
+
+//failed messages of queue "requestQueue" end up in exchange and queue "requestQueue.dead"
+func deadLetterName(queueName string) string {
+	return queueName + ".dead"
+}
+
+func declareDeadLetter(channel *amqp.Channel, queueName string) error {
+	name := deadLetterName(queueName)
+
+	err := channel.ExchangeDeclare(
+		name,     // name of the exchange
+		"fanout", // type
+		true,     // durable
+		false,    // delete when complete
+		false,    // internal
+		false,    // noWait
+		nil,      // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Dead Letter Exchange Declare: %s", err)
+	}
+
+	queue, err := channel.QueueDeclare(
+		name,  // name of the queue
+		true,  // durable
+		false, // delete when usused
+		false, // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Dead Letter Queue Declare: %s", err)
+	}
+
+	err = channel.QueueBind(
+		queue.Name, // name of the queue
+		"",         // bindingKey
+		name,       // sourceExchange
+		false,      // noWait
+		nil,        // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Dead Letter Queue Bind: %s", err)
+	}
+
+	log.Printf("declared Dead Letter Queue : %q ", queue.Name)
+
+	return nil
+}
+
+//DeadLetter moves d to the dead-letter queue with the failure attached as headers
+func (c *RabbitmqConsumer) DeadLetter(d amqp.Delivery, kind, reason string) error {
+	headers := copyHeaders(d)
+	headers["x-failure-kind"] = kind
+	headers["x-failure-reason"] = reason
+	headers["x-failure-time"] = time.Now().Unix()
+	headers["x-original-queue"] = c.queueName
+
+	err := c.republish(d, deadLetterName(c.queueName), d.RoutingKey, headers)
+	if err != nil {
+		return fmt.Errorf("Dead Letter Publish: %s", err)
+	}
+
+	return nil
+}
+
+func copyHeaders(d amqp.Delivery) amqp.Table {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+
+	return headers
+}
+
+//republish publishes a copy of d with the given headers and acks the original
+//d is requeued instead if the publish fails, so it is never lost
+func (c *RabbitmqConsumer) republish(d amqp.Delivery, exchange, key string, headers amqp.Table) error {
+	err := c.Publish(exchange, key, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+	if err != nil {
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			return fmt.Errorf("%s, Nack: %s", err, nackErr)
+		}
+		return err
+	}
+
+	return d.Ack(false)
+}
@@ -0,0 +1,192 @@
+package connectionHandler
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//MemoryStore is a DocStore kept in process memory, meant for tests and local runs
+type MemoryStore struct {
+	lock    sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+//buckets are created on first use
+func (s *MemoryStore) GetBucket(bucketname string) (Bucket, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bucket, exist := s.buckets[bucketname]
+	if !exist {
+		bucket = &memoryBucket{docs: make(map[string]memoryDoc)}
+		s.buckets[bucketname] = bucket
+	}
+
+	return bucket, nil
+}
+
+func (s *MemoryStore) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.buckets = make(map[string]*memoryBucket)
+}
+
+type memoryDoc struct {
+	value   []byte
+	cas     uint64
+	expires time.Time
+}
+
+type memoryBucket struct {
+	lock    sync.Mutex
+	docs    map[string]memoryDoc
+	lastCas uint64
+}
+
+//same rule as couchbase, see Bucket
+func expiryTime(exp int) time.Time {
+	switch {
+	case exp <= 0:
+		return time.Time{}
+	case exp <= 30*24*60*60:
+		return time.Now().Add(time.Duration(exp) * time.Second)
+	default:
+		return time.Unix(int64(exp), 0)
+	}
+}
+
+//lock must be held
+func (b *memoryBucket) lookup(key string) (memoryDoc, bool) {
+	doc, exist := b.docs[key]
+	if exist && !doc.expires.IsZero() && !time.Now().Before(doc.expires) {
+		delete(b.docs, key)
+		return memoryDoc{}, false
+	}
+
+	return doc, exist
+}
+
+//lock must be held
+func (b *memoryBucket) store(key string, value []byte, exp int) uint64 {
+	b.lastCas++
+	b.docs[key] = memoryDoc{value: value, cas: b.lastCas, expires: expiryTime(exp)}
+
+	return b.lastCas
+}
+
+func (b *memoryBucket) Get(key string, v interface{}) error {
+	var cas uint64
+	return b.Gets(key, v, &cas)
+}
+
+func (b *memoryBucket) Gets(key string, v interface{}, cas *uint64) error {
+	b.lock.Lock()
+	doc, exist := b.lookup(key)
+	b.lock.Unlock()
+
+	if !exist {
+		return ErrNotFound
+	}
+
+	*cas = doc.cas
+
+	return json.Unmarshal(doc.value, v)
+}
+
+func (b *memoryBucket) Set(key string, exp int, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.store(key, value, exp)
+
+	return nil
+}
+
+func (b *memoryBucket) Cas(key string, exp int, cas uint64, v interface{}) (uint64, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	doc, exist := b.lookup(key)
+	if !exist {
+		return 0, ErrNotFound
+	}
+	if doc.cas != cas {
+		return 0, ErrCasMismatch
+	}
+
+	return b.store(key, value, exp), nil
+}
+
+func (b *memoryBucket) Add(key string, exp int, v interface{}) (bool, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, exist := b.lookup(key); exist {
+		return false, nil
+	}
+
+	b.store(key, value, exp)
+
+	return true, nil
+}
+
+func (b *memoryBucket) Incr(key string, amt, def uint64, exp int) (uint64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	counter := def
+	doc, exist := b.lookup(key)
+	if exist {
+		current, err := strconv.ParseUint(string(doc.value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		counter = current + amt
+	}
+
+	value := []byte(strconv.FormatUint(counter, 10))
+	if exist {
+		//incrementing keeps the expiry the counter was created with
+		b.lastCas++
+		b.docs[key] = memoryDoc{value: value, cas: b.lastCas, expires: doc.expires}
+	} else {
+		b.store(key, value, exp)
+	}
+
+	return counter, nil
+}
+
+func (b *memoryBucket) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, exist := b.lookup(key); !exist {
+		return ErrNotFound
+	}
+
+	delete(b.docs, key)
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package connectionHandler
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+)
+
+func (c *RabbitmqConsumer) currentPublishChannel() *amqp.Channel {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.publishChannel
+}
+
+//Publish sends msg on the publishing channel of the current connection
+func (c *RabbitmqConsumer) Publish(exchange, key string, msg amqp.Publishing) error {
+	channel := c.currentPublishChannel()
+	if channel == nil || c.State() != Connected {
+		return fmt.Errorf("rabbitmq is %s", c.State())
+	}
+
+	return channel.Publish(
+		exchange, // publish to an exchange
+		key,      // routing to 0 or more queues
+		false,    // mandatory
+		false,    // immediate
+		msg,
+	)
+}
+
+//Reply sends body to the ReplyTo queue of d with its CorrelationId, it does nothing without ReplyTo
+func (c *RabbitmqConsumer) Reply(d amqp.Delivery, body []byte) error {
+	if d.ReplyTo == "" {
+		return nil
+	}
+
+	err := c.Publish("", d.ReplyTo, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: d.CorrelationId,
+		Body:          body,
+	})
+	if err != nil {
+		return fmt.Errorf("Reply Publish: %s", err)
+	}
+
+	return nil
+}
+
+//Enqueue publishes body to the queue the consumer reads, for follow-up work of a request
+func (c *RabbitmqConsumer) Enqueue(messageId string, body []byte) error {
+	err := c.Publish("", c.queueName, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageId,
+		Body:         body,
+	})
+	if err != nil {
+		return fmt.Errorf("Enqueue Publish: %s", err)
+	}
+
+	return nil
+}
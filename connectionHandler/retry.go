@@ -0,0 +1,97 @@
+package connectionHandler
+
+import (
+	"flag"
+	"fmt"
+	"github.com/streadway/amqp"
+	"log"
+	"time"
+)
+
+var (
+	retryDelay  = flag.Duration("retryDelay", time.Second, "delay before the first retry of a failed request")
+	retryLevels = flag.Int("retryLevels", 6, "number of retry queues, each one doubles the delay of the previous")
+)
+
+const retryCountHeader = "x-retry-count"
+
+//retry queue of the given level holds messages for retryDelay * 2^level
+func retryQueueDelay(level int) time.Duration {
+	return *retryDelay << uint(level)
+}
+
+func retryQueueName(queueName string, level int) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, retryQueueDelay(level)/time.Millisecond)
+}
+
+//each retry queue has no consumer, expired messages are dead-lettered back to queueName
+func declareRetryQueues(channel *amqp.Channel, queueName string) error {
+	for level := 0; level < *retryLevels; level++ {
+		queue, err := channel.QueueDeclare(
+			retryQueueName(queueName, level), // name of the queue
+			true,                             // durable
+			false,                            // delete when usused
+			false,                            // exclusive
+			false,                            // noWait
+			amqp.Table{
+				"x-message-ttl":             int64(retryQueueDelay(level) / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("Retry Queue Declare: %s", err)
+		}
+
+		log.Printf("declared Retry Queue : %q ", queue.Name)
+	}
+
+	return nil
+}
+
+//RetryCount returns how many times d has already been retried
+func RetryCount(d amqp.Delivery) int {
+	switch count := d.Headers[retryCountHeader].(type) {
+	case int16:
+		return int(count)
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	}
+
+	return 0
+}
+
+//WillRetry reports whether Retry would schedule d again rather than dead-letter it
+func WillRetry(d amqp.Delivery, maxAttempts int) bool {
+	return RetryCount(d)+1 < maxAttempts && *retryLevels > 0
+}
+
+//Retry schedules d to be delivered again after an exponential backoff
+//once d has been tried maxAttempts times it is moved to the dead-letter queue
+func (c *RabbitmqConsumer) Retry(d amqp.Delivery, maxAttempts int, kind, reason string) error {
+	retried := RetryCount(d)
+	if !WillRetry(d, maxAttempts) {
+		return c.DeadLetter(d, kind, fmt.Sprintf("gave up after %d attempts: %s", retried+1, reason))
+	}
+
+	level := retried
+	if level >= *retryLevels {
+		level = *retryLevels - 1
+	}
+
+	headers := copyHeaders(d)
+	headers[retryCountHeader] = int32(retried + 1)
+	headers["x-failure-kind"] = kind
+	headers["x-failure-reason"] = reason
+
+	err := c.republish(d, "", retryQueueName(c.queueName, level), headers)
+	if err != nil {
+		return fmt.Errorf("Retry Publish: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package connectionHandler
+
+import (
+	"errors"
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/go-couchbase"
+	"sync"
+)
+
+var (
+	//ErrNotFound is returned when the requested key does not exist
+	ErrNotFound = errors.New("document not found")
+	//ErrCasMismatch is returned by Cas when the document changed since it was read
+	ErrCasMismatch = errors.New("document changed since it was read")
+)
+
+//Bucket holds the document operations the request handlers use
+//values are stored as JSON, exp follows couchbase: 0 never expires,
+//up to 30 days it is relative in seconds, beyond that an absolute unix time
+type Bucket interface {
+	Get(key string, v interface{}) error
+	//Gets is Get that also returns the document's cas value
+	Gets(key string, v interface{}, cas *uint64) error
+	Set(key string, exp int, v interface{}) error
+	//Cas is Set that fails with ErrCasMismatch unless the document still has the given cas
+	Cas(key string, exp int, cas uint64, v interface{}) (uint64, error)
+	//Add returns false when the key already exists
+	Add(key string, exp int, v interface{}) (bool, error)
+	//Incr adds amt to a counter, a missing counter starts at def
+	Incr(key string, amt, def uint64, exp int) (uint64, error)
+	Delete(key string) error
+}
+
+//DocStore hands out buckets by name, buckets are shared and closed with the store
+type DocStore interface {
+	GetBucket(bucketname string) (Bucket, error)
+	Close()
+}
+
+var (
+	storeLock sync.RWMutex
+	store     DocStore
+)
+
+//UseStore makes GetBucket use s instead of the couchbase cluster given by -couchbase
+func UseStore(s DocStore) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	store = s
+}
+
+//returned bucket is shared, do not close it
+func GetBucket(bucketname string) (Bucket, error) {
+	storeLock.RLock()
+	s := store
+	storeLock.RUnlock()
+
+	if s != nil {
+		return s.GetBucket(bucketname)
+	}
+
+	couchConn, err := sharedCouchConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return couchConn.GetBucket(bucketname)
+}
+
+//IsNotFound reports whether err means the requested key does not exist
+func IsNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+
+	if res, ok := err.(*gomemcached.MCResponse); ok {
+		return res.Status == gomemcached.KEY_ENOENT
+	}
+
+	return false
+}
+
+//couchbaseBucket reports missing keys as ErrNotFound like every other Bucket
+type couchbaseBucket struct {
+	*couchbase.Bucket
+}
+
+func (b couchbaseBucket) Get(key string, v interface{}) error {
+	err := b.Bucket.Get(key, v)
+	if IsNotFound(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (b couchbaseBucket) Gets(key string, v interface{}, cas *uint64) error {
+	err := b.Bucket.Gets(key, v, cas)
+	if IsNotFound(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (b couchbaseBucket) Cas(key string, exp int, cas uint64, v interface{}) (uint64, error) {
+	newCas, err := b.Bucket.Cas(key, exp, cas, v)
+	if res, ok := err.(*gomemcached.MCResponse); ok && res.Status == gomemcached.KEY_EEXISTS {
+		return 0, ErrCasMismatch
+	}
+	if IsNotFound(err) {
+		return 0, ErrNotFound
+	}
+
+	return newCas, err
+}
+
+func (b couchbaseBucket) Delete(key string) error {
+	err := b.Bucket.Delete(key)
+	if IsNotFound(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
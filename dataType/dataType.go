@@ -1,5 +1,10 @@
 package dataType
 
+import (
+	"encoding/json"
+	"strconv"
+)
+
 type User struct {
 	Id           string
 	RegisterDate int64    `json:"registerDate"`
@@ -27,6 +32,39 @@ type Thread struct {
 	Content string   `json:"content"`
 	Image   string   `json:"image_url"`
 	Time    int64    `json:"pub_date"`
+	//users the thread was delivered to, Reader holds those who read it
+	Audience []string `json:"audience,omitempty"`
+	//set while threadDelete cleans up, the document is removed afterwards
+	Deleted bool `json:"deleted,omitempty"`
+	//earlier versions, oldest first
+	History []ThreadRevision `json:"history,omitempty"`
+	//delivered at read time instead of to the audience, see -pullThreshold
+	Pull bool `json:"pull,omitempty"`
+	//batches of the latest fan-out
+	Fanout *FanoutProgress `json:"fanout,omitempty"`
+}
+
+type FanoutProgress struct {
+	Round   string `json:"round"`
+	Batches int    `json:"batches"`
+	Done    []int  `json:"done"`
+}
+
+func (p *FanoutProgress) Complete() bool {
+	return len(p.Done) >= p.Batches
+}
+
+type ThreadRevision struct {
+	Content  string `json:"content"`
+	Image    string `json:"image_url"`
+	Public   string `json:"is_public"`
+	EditTime int64  `json:"edit_date"`
+}
+
+//IsPublic reports whether the thread is visible beyond the author's friends
+func (t *Thread) IsPublic() bool {
+	public, _ := strconv.ParseBool(t.Public)
+	return public
 }
 
 type Comment struct {
@@ -38,6 +76,60 @@ type Comment struct {
 	Block     []string `json:"blocks"`
 	Content   string   `json:"content"`
 	Time      int64    `json:"pub_date"`
+	//earlier contents, oldest first
+	History []CommentRevision `json:"history,omitempty"`
+}
+
+type CommentRevision struct {
+	Content  string `json:"content"`
+	EditTime int64  `json:"edit_date"`
+}
+
+//Timeline is the feed of one user, newest thread first
+type Timeline struct {
+	User    string          `json:"user"`
+	Entries []TimelineEntry `json:"entries"`
+}
+
+type TimelineEntry struct {
+	Thread_id string `json:"thread_id"`
+	Author    string `json:"author"`
+	Time      int64  `json:"pub_date"`
+	//only kept for the threads of pull authors, whose readers are checked at read time
+	Public bool `json:"is_public,omitempty"`
+}
+
+//PullAuthors lists the authors whose threads are pulled by their readers
+type PullAuthors struct {
+	Authors []string `json:"authors"`
+}
+
+//TimelineRequest asks for one page of the timeline of User
+type TimelineRequest struct {
+	User   string `json:"user"`
+	Action string `json:"action"`
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+//TimelinePage is one page of a timeline, Next is the cursor of the following page
+type TimelinePage struct {
+	Entries []TimelineEntry `json:"entries"`
+	Next    string          `json:"next,omitempty"`
+}
+
+//DirtyUsers is one shard of the users whose thread lists grew since the last compaction
+type DirtyUsers struct {
+	Users []string `json:"users"`
+}
+
+//FanoutRequest is one batch of recipients of fanoutUnread or fanoutRevoke
+type FanoutRequest struct {
+	Thread_id string   `json:"thread_id"`
+	Action    string   `json:"action"`
+	Round     string   `json:"round"`
+	Batch     int      `json:"batch"`
+	Users     []string `json:"users"`
 }
 
 type UserRequest struct {
@@ -52,6 +144,10 @@ type ThreadRequest struct {
 	User      string `json:"user"`
 	Action    string `json:"action"`
 	Time      int64  `json:"time"`
+	//fields changed by threadEdit, nil leaves the field as it is
+	Content *string `json:"content,omitempty"`
+	Image   *string `json:"image_url,omitempty"`
+	Public  *string `json:"is_public,omitempty"`
 }
 
 type CommentRequest struct {
@@ -59,4 +155,75 @@ type CommentRequest struct {
 	User       string `json:"user"`
 	Action     string `json:"action"`
 	Time       int64  `json:"time"`
+	//new content for commentEdit
+	Content string `json:"content,omitempty"`
+}
+
+//partition keys, requests sharing a key are processed one at a time in delivery order
+
+func (u *User) PartitionKey() string {
+	return "user:" + u.Id
+}
+
+func (t *Thread) PartitionKey() string {
+	return "user:" + t.Author
+}
+
+func (c *Comment) PartitionKey() string {
+	return "thread:" + c.Thread_id
+}
+
+func (r *UserRequest) PartitionKey() string {
+	return "user:" + r.User
+}
+
+func (r *TimelineRequest) PartitionKey() string {
+	return "user:" + r.User
+}
+
+//batches of one thread are handled in order, they all update its progress
+func (r *FanoutRequest) PartitionKey() string {
+	return "thread:" + r.Thread_id
+}
+
+func (r *ThreadRequest) PartitionKey() string {
+	return "thread:" + r.Thread_id
+}
+
+func (r *CommentRequest) PartitionKey() string {
+	return "comment:" + r.Comment_id
+}
+
+//progress of a multi-document request, kept until the request completes or is rolled back
+type Saga struct {
+	Id        string            `json:"id"`
+	Action    string            `json:"action"`
+	Status    string            `json:"status"`
+	Completed []string          `json:"completed"`
+	State     map[string]string `json:"state"`
+	Error     string            `json:"error"`
+	Time      int64             `json:"time"`
+}
+
+//result sent to the ReplyTo queue of a request once it succeeded or finally failed
+type Reply struct {
+	Action    string          `json:"action"`
+	Status    string          `json:"status"`
+	Id        string          `json:"id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+//version of the payload formats above, bump it with an upgrade from the previous version
+const CurrentVersion = 1
+
+//Envelope wraps a payload with its routing data
+//flat messages, the payload itself with an action field, are read as version 1
+type Envelope struct {
+	Version   int             `json:"version"`
+	Action    string          `json:"action"`
+	MessageId string          `json:"message_id"`
+	Timestamp int64           `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
 }
@@ -0,0 +1,253 @@
+package dataType
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+//limits counted in characters, not bytes
+const (
+	MaxThreadContent  = 2000
+	MaxCommentContent = 500
+	MaxImageURL       = 512
+	MaxFriendList     = 100
+	MaxFanoutBatch    = 1000
+	MaxTimelinePage   = 100
+	MaxCursor         = 128
+)
+
+var (
+	//user ids are chosen at registration
+	userIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+	//thread and comment ids come from the bucket counters
+	documentIdPattern = regexp.MustCompile(`^[1-9][0-9]{0,19}$`)
+	//cursors are unpadded url-safe base64
+	cursorPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+)
+
+//ValidationError names the first field of a payload that broke a rule
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+func validateUserId(field, id string) error {
+	if id == "" {
+		return invalid(field, "is required")
+	}
+	if !userIdPattern.MatchString(id) {
+		return invalid(field, "is not a valid user id")
+	}
+
+	return nil
+}
+
+func validateDocumentId(field, id string) error {
+	if id == "" {
+		return invalid(field, "is required")
+	}
+	if !documentIdPattern.MatchString(id) {
+		return invalid(field, "is not a valid id")
+	}
+
+	return nil
+}
+
+func validateLength(field, value string, max int) error {
+	if length := utf8.RuneCountInString(value); length > max {
+		return invalid(field, "is %d characters long, limit is %d", length, max)
+	}
+
+	return nil
+}
+
+//Validate checks the payload of userRegister
+func (u *User) Validate(action string) error {
+	return validateUserId("id", u.Id)
+}
+
+//Validate checks the payload of newThread
+func (t *Thread) Validate(action string) error {
+	if err := validateUserId("author", t.Author); err != nil {
+		return err
+	}
+	if t.Content == "" && t.Image == "" {
+		return invalid("content", "is required without image_url")
+	}
+	if err := validateLength("content", t.Content, MaxThreadContent); err != nil {
+		return err
+	}
+	if err := validateLength("image_url", t.Image, MaxImageURL); err != nil {
+		return err
+	}
+	if t.Public != "" {
+		if _, err := strconv.ParseBool(t.Public); err != nil {
+			return invalid("is_public", "must be a boolean")
+		}
+	}
+
+	//the rest is kept by the server, a producer must not start a thread with it
+	switch {
+	case len(t.Like) > 0:
+		return invalid("likes", "is set by the server")
+	case len(t.Report) > 0:
+		return invalid("reports", "is set by the server")
+	case len(t.Block) > 0:
+		return invalid("blocks", "is set by the server")
+	case len(t.Reader) > 0:
+		return invalid("readers", "is set by the server")
+	case len(t.Comment) > 0:
+		return invalid("comments", "is set by the server")
+	case len(t.Audience) > 0:
+		return invalid("audience", "is set by the server")
+	case len(t.History) > 0:
+		return invalid("history", "is set by the server")
+	case t.Deleted:
+		return invalid("deleted", "is set by the server")
+	case t.Pull:
+		return invalid("pull", "is set by the server")
+	case t.Fanout != nil:
+		return invalid("fanout", "is set by the server")
+	}
+
+	return nil
+}
+
+//Validate checks the payload of commentAdd
+func (c *Comment) Validate(action string) error {
+	if err := validateDocumentId("thread_id", c.Thread_id); err != nil {
+		return err
+	}
+	if err := validateUserId("author", c.Author); err != nil {
+		return err
+	}
+	if c.Content == "" {
+		return invalid("content", "is required")
+	}
+
+	return validateLength("content", c.Content, MaxCommentContent)
+}
+
+//Validate checks the payload of user actions, only friendAdd and friendDelete carry a friendList
+func (r *UserRequest) Validate(action string) error {
+	if err := validateUserId("user", r.User); err != nil {
+		return err
+	}
+
+	switch action {
+	case `friendAdd`, `friendDelete`:
+		if len(r.FriendList) == 0 {
+			return invalid("friendList", "is empty")
+		}
+		if len(r.FriendList) > MaxFriendList {
+			return invalid("friendList", "has %d users, limit is %d", len(r.FriendList), MaxFriendList)
+		}
+		for _, friend_id := range r.FriendList {
+			if err := validateUserId("friendList", friend_id); err != nil {
+				return err
+			}
+			if friend_id == r.User {
+				return invalid("friendList", "contains the user itself")
+			}
+		}
+	}
+
+	return nil
+}
+
+//Validate checks the payload of thread actions
+func (r *ThreadRequest) Validate(action string) error {
+	if err := validateDocumentId("thread_id", r.Thread_id); err != nil {
+		return err
+	}
+	if err := validateUserId("user", r.User); err != nil {
+		return err
+	}
+
+	if action == `threadEdit` {
+		if r.Content == nil && r.Image == nil && r.Public == nil {
+			return invalid("content", "one of content, image_url or is_public is required")
+		}
+		if r.Content != nil {
+			if err := validateLength("content", *r.Content, MaxThreadContent); err != nil {
+				return err
+			}
+		}
+		if r.Image != nil {
+			if err := validateLength("image_url", *r.Image, MaxImageURL); err != nil {
+				return err
+			}
+		}
+		if r.Public != nil {
+			if _, err := strconv.ParseBool(*r.Public); err != nil {
+				return invalid("is_public", "must be a boolean")
+			}
+		}
+	}
+
+	return nil
+}
+
+//Validate checks the payload of comment actions
+func (r *CommentRequest) Validate(action string) error {
+	if err := validateDocumentId("comment_id", r.Comment_id); err != nil {
+		return err
+	}
+	if err := validateUserId("user", r.User); err != nil {
+		return err
+	}
+
+	if action == `commentEdit` {
+		if r.Content == "" {
+			return invalid("content", "is required")
+		}
+		return validateLength("content", r.Content, MaxCommentContent)
+	}
+
+	return nil
+}
+
+//Validate checks a batch of fanoutUnread or fanoutRevoke
+func (r *FanoutRequest) Validate(action string) error {
+	if err := validateDocumentId("thread_id", r.Thread_id); err != nil {
+		return err
+	}
+	if len(r.Users) == 0 {
+		return invalid("users", "is empty")
+	}
+	if len(r.Users) > MaxFanoutBatch {
+		return invalid("users", "has %d users, limit is %d", len(r.Users), MaxFanoutBatch)
+	}
+	for _, user_id := range r.Users {
+		if err := validateUserId("users", user_id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Validate checks the payload of timelineRead, the cursor is only checked for its form
+func (r *TimelineRequest) Validate(action string) error {
+	if err := validateUserId("user", r.User); err != nil {
+		return err
+	}
+	if r.Limit < 0 || r.Limit > MaxTimelinePage {
+		return invalid("limit", "must be between 0 and %d", MaxTimelinePage)
+	}
+	if len(r.Cursor) > MaxCursor || !cursorPattern.MatchString(r.Cursor) {
+		return invalid("cursor", "is malformed")
+	}
+
+	return nil
+}
@@ -5,6 +5,9 @@ import (
 	"./requestHandler"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	//"database/sql"
 	//_ "github.com/go-sql-driver/mysql"
 )
@@ -24,16 +27,37 @@ func main() {
 	//to use connection, use var couchConn
 	//couchbaseConn, err := connectionHandler.CreateCouchbaseConn(*couchbaseURI)
 
+	log.Printf("registered actions: %v", requestHandler.RegisteredActions())
+
 	//connect to rabbitmq to get request
 	c, err := connectionHandler.CreateRabbitmqConsumer(*rabbitmqURI, *mainQueue, requestHandler.RouteRequest)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
-	log.Printf("running forever")
-	select {}
+	//users whose thread lists grew are trimmed in the background
+	stopCompaction := make(chan struct{})
+	go requestHandler.RunCompaction(stopCompaction)
+
+	//stop on ctrl-c or when the deploy asks us to
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	log.Printf("running until interrupted")
+	log.Printf("received %s, shutting down", <-signals)
+
+	close(stopCompaction)
+
+	//in-flight requests finish before the stores they write to go away
+	if err := c.Drain(); err != nil {
+		log.Printf("error during drain, unacknowledged requests will be redelivered: %s", err)
+	}
+
+	connectionHandler.CloseCouchbase()
 
-	log.Printf("shutting down")
+	log.Printf("cas conflicts per action: %v", requestHandler.ConflictCounts())
+	log.Printf("new threads per fan-out mode: %v", requestHandler.FanoutModeCounts())
+	log.Printf("trimmed thread ids per reason: %v", requestHandler.TrimCounts())
 
 	if err := c.RabbitmqShutdown(); err != nil {
 		log.Fatalf("error during shutdown: %s", err)
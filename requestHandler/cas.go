@@ -0,0 +1,83 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"flag"
+	"reflect"
+	"sync"
+)
+
+var casRetries = flag.Int("casRetries", 10, "attempts of a read-modify-write before cas conflicts are given up")
+
+var (
+	conflictLock   sync.Mutex
+	conflictCounts = make(map[string]uint64)
+)
+
+//ConflictCounts returns the number of cas conflicts per action since the worker started
+func ConflictCounts() map[string]uint64 {
+	conflictLock.Lock()
+	defer conflictLock.Unlock()
+
+	counts := make(map[string]uint64, len(conflictCounts))
+	for action, count := range conflictCounts {
+		counts[action] = count
+	}
+
+	return counts
+}
+
+func countConflict(action string) {
+	conflictLock.Lock()
+	defer conflictLock.Unlock()
+
+	conflictCounts[action]++
+}
+
+//updateDocument reads key into doc, calls mutate and writes doc back with cas
+//on a cas conflict doc is read again and mutate is called again, so mutate must only rely on doc
+func updateDocument(action string, bucket connectionHandler.Bucket, key string, doc interface{}, mutate func() error) error {
+	for attempt := 0; attempt < *casRetries; attempt++ {
+		//fields missing from the stored document must not survive from the previous attempt
+		reflect.ValueOf(doc).Elem().Set(reflect.Zero(reflect.TypeOf(doc).Elem()))
+
+		var cas uint64
+		err := bucket.Gets(key, doc, &cas)
+		if err != nil {
+			return storageError(err, "Failed to get document %q", key)
+		}
+
+		err = mutate()
+		if err != nil {
+			return err
+		}
+
+		_, err = bucket.Cas(key, 0, cas, doc)
+		if err == nil {
+			return nil
+		}
+		if err != connectionHandler.ErrCasMismatch {
+			return storageError(err, "Failed to re-write document %q", key)
+		}
+
+		countConflict(action)
+	}
+
+	return newRequestError(StorageFailure, "document %q kept changing, gave up after %d cas conflicts", key, *casRetries)
+}
+
+//upsertDocument is updateDocument for documents created on first use, a missing key is added as empty first
+func upsertDocument(action string, bucket connectionHandler.Bucket, key string, doc, empty interface{}, mutate func() error) error {
+	err := updateDocument(action, bucket, key, doc, mutate)
+	if ErrorKindOf(err) != NotFound {
+		return err
+	}
+
+	//a concurrent first write may win the Add, the update below then sees its document
+	_, err = bucket.Add(key, 0, empty)
+	if err != nil {
+		return storageError(err, "Failed to create document %q", key)
+	}
+
+	return updateDocument(action, bucket, key, doc, mutate)
+}
@@ -0,0 +1,91 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"testing"
+)
+
+//racingBucket lets another writer change key just before each of the first races Cas calls
+type racingBucket struct {
+	connectionHandler.Bucket
+	races int
+}
+
+func (b *racingBucket) Cas(key string, exp int, cas uint64, v interface{}) (uint64, error) {
+	if b.races > 0 {
+		b.races--
+
+		var user dataType.User
+		b.Bucket.Get(key, &user)
+		user.Follower = append(user.Follower, "racer")
+		b.Bucket.Set(key, 0, user)
+	}
+
+	return b.Bucket.Cas(key, exp, cas, v)
+}
+
+func racingUserBucket(t *testing.T, races int) *racingBucket {
+	useMemoryStore(t)
+	setDoc(t, "User", "alice", dataType.User{Id: "alice"})
+
+	bucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &racingBucket{Bucket: bucket, races: races}
+}
+
+func TestUpdateDocumentRetriesConflicts(t *testing.T) {
+	bucket := racingUserBucket(t, 2)
+	before := ConflictCounts()["casTest"]
+
+	var user dataType.User
+	calls := 0
+	err := updateDocument("casTest", bucket, "alice", &user, func() error {
+		calls++
+		user.Following = appendUnique(user.Following, "bob")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 {
+		t.Fatalf("mutate called %d times, want 3", calls)
+	}
+	if conflicts := ConflictCounts()["casTest"] - before; conflicts != 2 {
+		t.Fatalf("%d conflicts counted, want 2", conflicts)
+	}
+
+	//the racing writes are kept, mutate ran on top of them
+	stored := getUser(t, "alice")
+	sameList(t, "following", stored.Following, "bob")
+	sameList(t, "follower", stored.Follower, "racer", "racer")
+}
+
+func TestUpdateDocumentGivesUp(t *testing.T) {
+	bucket := racingUserBucket(t, *casRetries)
+
+	var user dataType.User
+	err := updateDocument("casTest", bucket, "alice", &user, func() error {
+		user.Following = appendUnique(user.Following, "bob")
+		return nil
+	})
+	if ErrorKindOf(err) != StorageFailure || !isTransient(err) {
+		t.Fatalf("err = %v, want a transient storage failure", err)
+	}
+	sameList(t, "following", getUser(t, "alice").Following)
+}
+
+func TestUpdateDocumentMissing(t *testing.T) {
+	useMemoryStore(t)
+	bucket, _ := connectionHandler.GetBucket("User")
+
+	var user dataType.User
+	err := updateDocument("casTest", bucket, "nobody", &user, func() error { return nil })
+	if ErrorKindOf(err) != NotFound {
+		t.Fatalf("err = %v, want not found", err)
+	}
+}
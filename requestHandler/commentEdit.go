@@ -0,0 +1,97 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"time"
+)
+
+func init() {
+	RegisterAction(`commentEdit`, func() interface{} { return &dataType.CommentRequest{} }, editComment)
+	RegisterAction(`commentDelete`, func() interface{} { return &dataType.CommentRequest{} }, removeComment)
+}
+
+//requestTime is the time the producer gave the request, or now for producers that send none
+func requestTime(time_ int64) int64 {
+	if time_ > 0 {
+		return time_
+	}
+
+	return time.Now().Unix()
+}
+
+//editComment replaces the content and keeps the previous one in the history
+func editComment(req *Request) error {
+	request := req.Payload.(*dataType.CommentRequest)
+
+	commentBucket, err := connectionHandler.GetBucket("Comment")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var comment dataType.Comment
+	return updateDocument(req.Action, commentBucket, request.Comment_id, &comment, func() error {
+		if comment.Author != request.User {
+			return newRequestError(Forbidden, "%q is not the author of comment %s", request.User, request.Comment_id)
+		}
+
+		//a redelivered edit must not add the same revision twice
+		if comment.Content == request.Content {
+			return nil
+		}
+
+		comment.History = append(comment.History, dataType.CommentRevision{
+			Content:  comment.Content,
+			EditTime: requestTime(request.Time),
+		})
+		comment.Content = request.Content
+
+		return nil
+	})
+}
+
+//removeComment unlinks the comment from its thread and users before removing the document,
+//so a retry after a failure still finds the comment and finishes
+func removeComment(req *Request) error {
+	request := req.Payload.(*dataType.CommentRequest)
+
+	commentBucket, err := connectionHandler.GetBucket("Comment")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var comment dataType.Comment
+	err = commentBucket.Get(request.Comment_id, &comment)
+	//already gone
+	if connectionHandler.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return storageError(err, "Failed to get comment %s", request.Comment_id)
+	}
+
+	if comment.Author != request.User {
+		return newRequestError(Forbidden, "%q is not the author of comment %s", request.User, request.Comment_id)
+	}
+
+	var thread dataType.Thread
+	err = updateDocument(req.Action, threadBucket, comment.Thread_id, &thread, func() error {
+		thread.Comment = removeItem(thread.Comment, comment.Id)
+		return nil
+	})
+	if err != nil && ErrorKindOf(err) != NotFound {
+		return err
+	}
+
+	return deleteComment(req.Action, commentBucket, userBucket, comment.Id)
+}
@@ -0,0 +1,65 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"testing"
+)
+
+//commentOfBob posts thread 1 of alice with comment 1 of bob that carol likes
+func commentOfBob(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob", "carol")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+	process(t, `{"action":"commentAdd","thread_id":"1","author":"bob","content":"hi"}`)
+	process(t, `{"action":"commentLike","comment_id":"1","user":"carol"}`)
+}
+
+func getComment(t *testing.T, comment_id string) dataType.Comment {
+	var comment dataType.Comment
+	getDoc(t, "Comment", comment_id, &comment)
+	return comment
+}
+
+func TestCommentEdit(t *testing.T) {
+	commentOfBob(t)
+
+	edit := `{"action":"commentEdit","comment_id":"1","user":"bob","content":"hello","time":200}`
+	process(t, edit)
+	//a redelivery adds no second revision
+	process(t, edit)
+
+	comment := getComment(t, "1")
+	if comment.Content != "hello" {
+		t.Fatalf("content = %q, want hello", comment.Content)
+	}
+	if len(comment.History) != 1 || comment.History[0] != (dataType.CommentRevision{Content: "hi", EditTime: 200}) {
+		t.Fatalf("history = %+v, want the first content edited at 200", comment.History)
+	}
+}
+
+func TestCommentEditByOthers(t *testing.T) {
+	commentOfBob(t)
+
+	processKind(t, `{"action":"commentEdit","comment_id":"1","user":"alice","content":"mine"}`, Forbidden)
+	processKind(t, `{"action":"commentEdit","comment_id":"2","user":"bob","content":"hello"}`, NotFound)
+
+	if comment := getComment(t, "1"); comment.Content != "hi" || len(comment.History) != 0 {
+		t.Fatalf("comment = %+v, want it unchanged", comment)
+	}
+}
+
+func TestCommentDelete(t *testing.T) {
+	commentOfBob(t)
+
+	processKind(t, `{"action":"commentDelete","comment_id":"1","user":"alice"}`, Forbidden)
+	getComment(t, "1")
+
+	process(t, `{"action":"commentDelete","comment_id":"1","user":"bob"}`)
+	missingDoc(t, "Comment", "1")
+	sameList(t, "thread comments", getThread(t, "1").Comment)
+	sameList(t, "bob writeComment", getUser(t, "bob").WriteComment)
+	sameList(t, "carol likeComment", getUser(t, "carol").LikeComment)
+
+	//a redelivery finds the comment gone
+	process(t, `{"action":"commentDelete","comment_id":"1","user":"bob"}`)
+}
@@ -0,0 +1,320 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"flag"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	unreadLimit     = flag.Int("unreadLimit", 500, "threads kept in the unread list of a user, the oldest are dropped, 0 keeps all")
+	readedLimit     = flag.Int("readedLimit", 500, "threads kept in the readed list of a user, the oldest are dropped, 0 keeps all")
+	threadMaxAge    = flag.Duration("threadMaxAge", 30*24*time.Hour, "compaction drops threads older than this by pub_date from unread and readed lists, 0 keeps them")
+	compactInterval = flag.Duration("compactInterval", time.Hour, "how often users whose thread lists grew are compacted, 0 disables compaction")
+	compactShards   = flag.Int("compactShards", 16, "documents the users waiting for compaction are spread over, must be the same on every worker")
+)
+
+//a user waiting for compaction has a marker and is listed in one shard, ':' never appears in a user id
+func dirtyMarkerKey(user_id string) string {
+	return "dirty:" + user_id
+}
+
+func dirtyShardKey(shard int) string {
+	return "compact:dirty:" + strconv.Itoa(shard)
+}
+
+func dirtyShards() int {
+	if *compactShards < 1 {
+		return 1
+	}
+
+	return *compactShards
+}
+
+func init() {
+	RegisterAction(`compactUnread`, func() interface{} { return &dataType.UserRequest{} }, compactUser)
+}
+
+var (
+	trimLock   sync.Mutex
+	trimCounts = make(map[string]uint64)
+)
+
+//TrimCounts returns the number of thread ids dropped from user lists per reason since the worker started
+func TrimCounts() map[string]uint64 {
+	trimLock.Lock()
+	defer trimLock.Unlock()
+
+	counts := make(map[string]uint64, len(trimCounts))
+	for reason, count := range trimCounts {
+		counts[reason] = count
+	}
+
+	return counts
+}
+
+func countTrim(reason string, count int) {
+	if count == 0 {
+		return
+	}
+
+	trimLock.Lock()
+	defer trimLock.Unlock()
+
+	trimCounts[reason] += uint64(count)
+}
+
+type byThreadId []string
+
+func (a byThreadId) Len() int           { return len(a) }
+func (a byThreadId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byThreadId) Less(i, j int) bool { return threadIdLess(a[i], a[j]) }
+
+//capThreads drops the oldest ids beyond limit, ids are created in order so no thread has to be read
+func capThreads(list []string, limit int) ([]string, int) {
+	if limit <= 0 || len(list) <= limit {
+		return list, 0
+	}
+
+	oldest := append([]string(nil), list...)
+	sort.Sort(byThreadId(oldest))
+	oldest = oldest[:len(list)-limit]
+
+	kept := make([]string, 0, limit)
+	for _, thread_id := range list {
+		if !containItem(oldest, thread_id) {
+			kept = append(kept, thread_id)
+		}
+	}
+
+	return kept, len(list) - len(kept)
+}
+
+//capThreadLists applies -unreadLimit and -readedLimit to user and returns how many ids it dropped
+//callers run it inside updateDocument and count the trims once the write succeeded
+func capThreadLists(user *dataType.User) (unread, readed int) {
+	user.UnreadThread, unread = capThreads(user.UnreadThread, *unreadLimit)
+	user.ReadedThread, readed = capThreads(user.ReadedThread, *readedLimit)
+	return unread, readed
+}
+
+func dirtyBucket() (connectionHandler.Bucket, error) {
+	bucket, err := connectionHandler.GetBucket("Compaction")
+	if err != nil {
+		return nil, storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	return bucket, nil
+}
+
+//markDirty queues users for the next compaction
+//only the first mark of a user since the last sweep writes its shard, later ones stop at the
+//marker, an Add that needs no cas, so busy users do not turn the shards into hot keys
+func markDirty(action string, users []string) error {
+	if len(users) == 0 || *compactInterval <= 0 {
+		return nil
+	}
+
+	bucket, err := dirtyBucket()
+	if err != nil {
+		return err
+	}
+
+	//the marker outlives a sweep that died before removing it only by a while
+	ttl := int(2 * *compactInterval / time.Second)
+	if ttl > 30*24*60*60 {
+		ttl = 30 * 24 * 60 * 60
+	}
+
+	shards := make(map[int][]string)
+	for _, user_id := range users {
+		added, err := bucket.Add(dirtyMarkerKey(user_id), ttl, true)
+		if err != nil {
+			return storageError(err, "Failed to mark %q for compaction", user_id)
+		}
+		if added {
+			shard := int(hashKey(user_id) % uint32(dirtyShards()))
+			shards[shard] = append(shards[shard], user_id)
+		}
+	}
+
+	for shard, shardUsers := range shards {
+		err = addToShard(action, bucket, shard, shardUsers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addToShard(action string, bucket connectionHandler.Bucket, shard int, users []string) error {
+	var dirty dataType.DirtyUsers
+	return upsertDocument(action, bucket, dirtyShardKey(shard), &dirty, dataType.DirtyUsers{}, func() error {
+		for _, user_id := range users {
+			dirty.Users = appendUnique(dirty.Users, user_id)
+		}
+		return nil
+	})
+}
+
+//compactUser drops the threads of a user that were deleted or are older than -threadMaxAge,
+//then applies the caps
+func compactUser(req *Request) error {
+	request := req.Payload.(*dataType.UserRequest)
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var user dataType.User
+	err = userBucket.Get(request.User, &user)
+	if connectionHandler.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return storageError(err, "Failed to get user %q", request.User)
+	}
+
+	var cutoff int64
+	if *threadMaxAge > 0 {
+		cutoff = time.Now().Add(-*threadMaxAge).Unix()
+	}
+
+	//ids found stale here, ids added while this runs are left for the next compaction
+	stale := make(map[string]string)
+	for _, thread_id := range append(append([]string(nil), user.UnreadThread...), user.ReadedThread...) {
+		if _, checked := stale[thread_id]; checked {
+			continue
+		}
+
+		var thread dataType.Thread
+		err = threadBucket.Get(thread_id, &thread)
+		switch {
+		case connectionHandler.IsNotFound(err):
+			stale[thread_id] = "deleted"
+		case err != nil:
+			return storageError(err, "Failed to get thread %s", thread_id)
+		//threads stored without a pub_date have no age to go by
+		case thread.Time != 0 && thread.Time < cutoff:
+			stale[thread_id] = "age"
+		default:
+			stale[thread_id] = ""
+		}
+	}
+
+	var counts map[string]int
+	err = updateDocument(req.Action, userBucket, request.User, &user, func() error {
+		counts = make(map[string]int)
+		for _, list := range []struct {
+			name string
+			ids  *[]string
+		}{{"unread", &user.UnreadThread}, {"readed", &user.ReadedThread}} {
+			kept := (*list.ids)[:0]
+			for _, thread_id := range *list.ids {
+				if reason := stale[thread_id]; reason != "" {
+					counts[list.name+":"+reason]++
+					continue
+				}
+				kept = append(kept, thread_id)
+			}
+			*list.ids = kept
+		}
+
+		counts["unread:cap"], counts["readed:cap"] = capThreadLists(&user)
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for reason, count := range counts {
+		countTrim(reason, count)
+	}
+
+	return nil
+}
+
+//SweepDirtyUsers takes the users whose thread lists grew and queues a compactUnread request for each
+//several workers may sweep at once, cas hands every user to one of them
+func SweepDirtyUsers() (int, error) {
+	bucket, err := dirtyBucket()
+	if err != nil {
+		return 0, err
+	}
+
+	sweep := strconv.FormatInt(time.Now().UnixNano(), 10)
+	queued := 0
+	for shard := 0; shard < dirtyShards(); shard++ {
+		var dirty dataType.DirtyUsers
+		var users []string
+		err = updateDocument(`compactUnread`, bucket, dirtyShardKey(shard), &dirty, func() error {
+			users = dirty.Users
+			dirty.Users = nil
+			return nil
+		})
+		if ErrorKindOf(err) == NotFound {
+			continue
+		}
+		if err != nil {
+			return queued, err
+		}
+
+		for i, user_id := range users {
+			//changes after this point mark the user again for the next sweep
+			err = deleteDocument(bucket, dirtyMarkerKey(user_id))
+			if err == nil {
+				err = enqueueRequest(`compactUnread`, "compactUnread:"+user_id+":"+sweep, &dataType.UserRequest{User: user_id, Action: `compactUnread`})
+			}
+			if err != nil {
+				//the users not queued wait for the next sweep
+				if shardErr := addToShard(`compactUnread`, bucket, shard, users[i:]); shardErr != nil {
+					log.Printf("lost %d users to compact: %s", len(users)-i, shardErr)
+				}
+				return queued, err
+			}
+			queued++
+		}
+	}
+
+	return queued, nil
+}
+
+//RunCompaction sweeps every -compactInterval until stop is closed
+func RunCompaction(stop <-chan struct{}) {
+	if *compactInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		queued, err := SweepDirtyUsers()
+		if err != nil {
+			log.Printf("compaction sweep failed after %d users: %s", queued, err)
+			continue
+		}
+		log.Printf("queued compaction of %d users, trimmed so far: %v", queued, TrimCounts())
+	}
+}
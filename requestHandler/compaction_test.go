@@ -0,0 +1,113 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"testing"
+	"time"
+)
+
+func TestNewThreadDefaultsPubDate(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	before := time.Now().Unix()
+	process(t, `{"action":"newThread","author":"alice","content":"hello"}`)
+
+	if date := getThread(t, "1").Time; date < before || date > time.Now().Unix() {
+		t.Fatalf("pub_date = %d, want the time of the request", date)
+	}
+}
+
+func TestCompactionTrimsStaleThreads(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	old := time.Now().Add(-2 * *threadMaxAge).Unix()
+	postThreads(t, "alice", old)
+	process(t, `{"action":"newThread","author":"alice","content":"no pub_date"}`)
+	postThreads(t, "alice", time.Now().Unix())
+
+	//thread 4 never existed, thread 5 is stored as older producers did, without a pub_date
+	setDoc(t, "Thread", "5", dataType.Thread{Id: "5", Author: "alice"})
+	bob := getUser(t, "bob")
+	bob.UnreadThread = append(bob.UnreadThread, "4", "5")
+	setDoc(t, "User", "bob", bob)
+
+	before := TrimCounts()
+	queued, err := SweepDirtyUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued == 0 {
+		t.Fatal("bob was not queued for compaction")
+	}
+
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "2", "3", "5")
+	after := TrimCounts()
+	for reason, want := range map[string]uint64{"unread:age": 1, "unread:deleted": 1} {
+		if got := after[reason] - before[reason]; got != want {
+			t.Fatalf("%s trimmed %d, want %d", reason, got, want)
+		}
+	}
+}
+
+func TestFanoutCapsUnread(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	unread, readed := *unreadLimit, *readedLimit
+	*unreadLimit, *readedLimit = 2, 1
+	defer func() { *unreadLimit, *readedLimit = unread, readed }()
+
+	for i := 1; i <= 4; i++ {
+		postThreads(t, "alice", int64(100*i))
+	}
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "3", "4")
+
+	//reading keeps the readed list within its cap too
+	process(t, `{"action":"threadReadAll","user":"bob"}`)
+	sameList(t, "bob readedThread", getUser(t, "bob").ReadedThread, "4")
+}
+
+func dirtyUsers(t *testing.T) []string {
+	var users []string
+	for shard := 0; shard < dirtyShards(); shard++ {
+		var dirty dataType.DirtyUsers
+		bucket, _ := dirtyBucket()
+		if err := bucket.Get(dirtyShardKey(shard), &dirty); err == nil {
+			users = append(users, dirty.Users...)
+		}
+	}
+	return users
+}
+
+func TestMarkDirtyOncePerSweep(t *testing.T) {
+	useMemoryStore(t)
+
+	users := []string{"alice", "bob", "carol", "dave"}
+	if err := markDirty("test", users); err != nil {
+		t.Fatal(err)
+	}
+	if err := markDirty("test", users[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirtyUsers(t); len(got) != len(users) {
+		t.Fatalf("dirty users = %v, want each of %v once", got, users)
+	}
+
+	//users that are gone are swept without an error
+	queued, err := SweepDirtyUsers()
+	if err != nil || queued != len(users) {
+		t.Fatalf("sweep queued %d (%v), want %d", queued, err, len(users))
+	}
+	if got := dirtyUsers(t); len(got) != 0 {
+		t.Fatalf("dirty users after sweep = %v", got)
+	}
+	missingDoc(t, "Compaction", dirtyMarkerKey("alice"))
+
+	//the marker is gone, so the next change marks the user again
+	if err := markDirty("test", users[:1]); err != nil {
+		t.Fatal(err)
+	}
+	sameList(t, "dirty users", dirtyUsers(t), "alice")
+}
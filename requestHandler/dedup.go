@@ -0,0 +1,66 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"encoding/json"
+	"flag"
+	"log"
+	"time"
+)
+
+var dedupTTL = flag.Duration("dedupTTL", 24*time.Hour, "how long processed message ids are remembered")
+
+//processed message ids live in the Processed bucket until dedupTTL expires them
+//Result and Data are kept so a duplicate gets the same reply as the original
+type processedMark struct {
+	Action string          `json:"action"`
+	Result string          `json:"result"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Time   int64           `json:"time"`
+}
+
+//isProcessed reports whether a request with the same message id already succeeded
+//and restores its Result, requests without a message id are never skipped
+func isProcessed(req *Request) (bool, error) {
+	if req.MessageId == "" {
+		return false, nil
+	}
+
+	bucket, err := connectionHandler.GetBucket("Processed")
+	if err != nil {
+		return false, storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var mark processedMark
+	err = bucket.Get(req.MessageId, &mark)
+	if connectionHandler.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, storageError(err, "Failed to check message id %q", req.MessageId)
+	}
+
+	req.Result = mark.Result
+	req.Data = mark.Data
+
+	return true, nil
+}
+
+//markProcessed only logs failures, the request itself has already succeeded
+func markProcessed(req *Request) {
+	if req.MessageId == "" {
+		return
+	}
+
+	bucket, err := connectionHandler.GetBucket("Processed")
+	if err != nil {
+		log.Printf("failed to mark %q processed: %s", req.MessageId, err)
+		return
+	}
+
+	mark := processedMark{Action: req.Action, Result: req.Result, Data: req.Data, Time: time.Now().Unix()}
+	_, err = bucket.Add(req.MessageId, int(*dedupTTL/time.Second), mark)
+	if err != nil {
+		log.Printf("failed to mark %q processed: %s", req.MessageId, err)
+	}
+}
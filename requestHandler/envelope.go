@@ -0,0 +1,87 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+//Upgrade turns a payload of one version into the payload of the next version
+type Upgrade func(action string, payload json.RawMessage) (json.RawMessage, error)
+
+var (
+	upgradeLock sync.RWMutex
+	upgrades    = make(map[int]Upgrade)
+)
+
+//RegisterUpgrade sets the upgrade from version to version+1
+//together they let workers read anything older producers still send
+func RegisterUpgrade(version int, upgrade Upgrade) {
+	if version < 1 || version >= dataType.CurrentVersion {
+		panic(fmt.Sprintf("requestHandler: no upgrade from version %d to %d", version, version+1))
+	}
+
+	upgradeLock.Lock()
+	defer upgradeLock.Unlock()
+
+	upgrades[version] = upgrade
+}
+
+//decodeEnvelope reads an enveloped or a flat message and upgrades its payload to dataType.CurrentVersion
+func decodeEnvelope(body []byte) (dataType.Envelope, error) {
+	//flat messages carry the request id in the body
+	var message struct {
+		dataType.Envelope
+		RequestId string `json:"request_id"`
+	}
+
+	err := json.Unmarshal(body, &message)
+	if err != nil {
+		return dataType.Envelope{}, newRequestError(BadPayload, "Failed to decode request (%s)", err)
+	}
+
+	envelope := message.Envelope
+	if envelope.Payload == nil {
+		envelope = dataType.Envelope{
+			Version:   1,
+			Action:    message.Action,
+			MessageId: message.RequestId,
+			Payload:   body,
+		}
+	}
+
+	if envelope.Version < 1 {
+		return envelope, newRequestError(BadPayload, "invalid version %d", envelope.Version)
+	}
+
+	//a newer producer is ahead of this worker, an upgraded worker will take it
+	if envelope.Version > dataType.CurrentVersion {
+		return envelope, newRequestError(Unsupported, "version %d is newer than %d", envelope.Version, dataType.CurrentVersion)
+	}
+
+	err = upgradeEnvelope(&envelope, dataType.CurrentVersion)
+	return envelope, err
+}
+
+//upgradeEnvelope runs the registered upgrades until the payload is of version target
+func upgradeEnvelope(envelope *dataType.Envelope, target int) error {
+	upgradeLock.RLock()
+	defer upgradeLock.RUnlock()
+
+	var err error
+	for envelope.Version < target {
+		upgrade, exist := upgrades[envelope.Version]
+		if !exist {
+			return newRequestError(BadPayload, "no upgrade from version %d", envelope.Version)
+		}
+
+		envelope.Payload, err = upgrade(envelope.Action, envelope.Payload)
+		if err != nil {
+			return newRequestError(BadPayload, "Failed to upgrade from version %d (%s)", envelope.Version, err)
+		}
+		envelope.Version++
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestFlatAndEnvelopedMessages(t *testing.T) {
+	useMemoryStore(t)
+
+	process(t, `{"action":"userRegister","Id":"alice"}`)
+	process(t, `{"version":1,"action":"userRegister","message_id":"m1","payload":{"Id":"bob"}}`)
+	getUser(t, "alice")
+	getUser(t, "bob")
+
+	//the message id of the envelope is used for deduplication
+	process(t, `{"version":1,"action":"userRegister","message_id":"m1","payload":{"Id":"bob"}}`)
+}
+
+func TestEnvelopeVersions(t *testing.T) {
+	useMemoryStore(t)
+
+	processKind(t, `{"version":0,"action":"userRegister","payload":{"Id":"alice"}}`, BadPayload)
+
+	//a newer producer waits for an upgraded worker instead of being dead-lettered
+	err := ProcessMessage([]byte(`{"version":99,"action":"userRegister","payload":{"Id":"alice"}}`))
+	if ErrorKindOf(err) != Unsupported || !isTransient(err) {
+		t.Fatalf("err = %v, want a transient unsupported version", err)
+	}
+}
+
+func TestUpgradeChain(t *testing.T) {
+	//versions past dataType.CurrentVersion cannot be registered yet, so the chain is set up by hand
+	upgradeLock.Lock()
+	upgrades[1] = func(action string, payload json.RawMessage) (json.RawMessage, error) {
+		var v1 struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+		if v1.Name == "" {
+			return nil, errors.New("name is missing")
+		}
+		return json.Marshal(map[string]string{"Id": v1.Name})
+	}
+	upgradeLock.Unlock()
+	defer func() {
+		upgradeLock.Lock()
+		delete(upgrades, 1)
+		upgradeLock.Unlock()
+	}()
+
+	envelope := dataType.Envelope{Version: 1, Action: "userRegister", Payload: json.RawMessage(`{"name":"alice"}`)}
+	if err := upgradeEnvelope(&envelope, 2); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Version != 2 || string(envelope.Payload) != `{"Id":"alice"}` {
+		t.Fatalf("envelope = %d %s", envelope.Version, envelope.Payload)
+	}
+
+	envelope = dataType.Envelope{Version: 1, Payload: json.RawMessage(`{}`)}
+	if err := upgradeEnvelope(&envelope, 2); ErrorKindOf(err) != BadPayload {
+		t.Fatalf("err = %v, want bad payload", err)
+	}
+
+	envelope = dataType.Envelope{Version: 1, Payload: json.RawMessage(`{"name":"alice"}`)}
+	if err := upgradeEnvelope(&envelope, 3); ErrorKindOf(err) != BadPayload || envelope.Version != 2 {
+		t.Fatalf("missing upgrade: err = %v at version %d, want bad payload at 2", err, envelope.Version)
+	}
+}
+
+func TestRegisterUpgradeRejectsVersions(t *testing.T) {
+	for _, version := range []int{0, dataType.CurrentVersion} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("RegisterUpgrade(%d) did not panic", version)
+				}
+			}()
+			RegisterUpgrade(version, nil)
+		}()
+	}
+}
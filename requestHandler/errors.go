@@ -0,0 +1,114 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"fmt"
+)
+
+type ErrorKind int
+
+const (
+	//payload could not be decoded or is missing required data
+	BadPayload ErrorKind = iota
+	//document referenced by the request does not exist
+	NotFound
+	//document to create already exists
+	Conflict
+	//couchbase could not be reached or refused the operation
+	StorageFailure
+	//payload decoded but broke a validation rule of its action
+	Invalid
+	//message version is newer than this worker understands
+	Unsupported
+	//user may not run the action on the document
+	Forbidden
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case BadPayload:
+		return "bad payload"
+	case NotFound:
+		return "not found"
+	case Conflict:
+		return "conflict"
+	case StorageFailure:
+		return "storage failure"
+	case Invalid:
+		return "invalid"
+	case Unsupported:
+		return "unsupported version"
+	case Forbidden:
+		return "forbidden"
+	}
+
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+//Code is the error code sent in replies
+func (k ErrorKind) Code() string {
+	switch k {
+	case BadPayload:
+		return "bad_payload"
+	case NotFound:
+		return "not_found"
+	case Conflict:
+		return "conflict"
+	case StorageFailure:
+		return "storage_failure"
+	case Invalid:
+		return "invalid_request"
+	case Unsupported:
+		return "unsupported_version"
+	case Forbidden:
+		return "forbidden"
+	}
+
+	return "unknown"
+}
+
+//error returned by action handlers
+type RequestError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+//Transient reports whether the same request may succeed when processed again
+func (e *RequestError) Transient() bool {
+	return e.Kind == StorageFailure || e.Kind == Unsupported
+}
+
+func newRequestError(kind ErrorKind, format string, args ...interface{}) error {
+	return &RequestError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+//ErrorKindOf classifies err, errors not raised by a handler count as storage failures
+func ErrorKindOf(err error) ErrorKind {
+	if reqErr, ok := err.(*RequestError); ok {
+		return reqErr.Kind
+	}
+
+	return StorageFailure
+}
+
+func isTransient(err error) bool {
+	if reqErr, ok := err.(*RequestError); ok {
+		return reqErr.Transient()
+	}
+
+	return true
+}
+
+//storageError wraps a couchbase error, a missing key becomes NotFound
+func storageError(err error, format string, args ...interface{}) error {
+	kind := StorageFailure
+	if connectionHandler.IsNotFound(err) {
+		kind = NotFound
+	}
+
+	return &RequestError{Kind: kind, Err: fmt.Errorf(format+" (%s)", append(args, err)...)}
+}
@@ -0,0 +1,375 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"encoding/json"
+	"flag"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//FanoutPolicy decides who receives the threads of an author
+type FanoutPolicy interface {
+	//Candidates lists the users thread may be delivered to, judged from the author's document alone
+	Candidates(author *dataType.User, thread *dataType.Thread) []string
+	//Reaches reports whether user_id is one of the Candidates, pull mode asks it for a single reader
+	Reaches(author *dataType.User, thread *dataType.Thread, user_id string) bool
+	//Accepts runs on the latest document of each candidate, a false skips the delivery
+	Accepts(recipient *dataType.User, author string) bool
+}
+
+//visibilityPolicy delivers public threads to followers and the others to friends,
+//nobody gets a thread across a block in either direction
+type visibilityPolicy struct{}
+
+func (visibilityPolicy) Candidates(author *dataType.User, thread *dataType.Thread) []string {
+	audience := author.Friends
+	if thread.IsPublic() {
+		audience = author.Follower
+	}
+
+	//the author and blocked users are never candidates, seen drops duplicates of the list
+	seen := itemSet(author.BlockUser)
+	seen[author.Id] = true
+
+	candidates := make([]string, 0, len(audience))
+	for _, user_id := range audience {
+		if !seen[user_id] {
+			seen[user_id] = true
+			candidates = append(candidates, user_id)
+		}
+	}
+
+	return candidates
+}
+
+func (visibilityPolicy) Reaches(author *dataType.User, thread *dataType.Thread, user_id string) bool {
+	if user_id == author.Id || containItem(author.BlockUser, user_id) {
+		return false
+	}
+	if thread.IsPublic() {
+		return containItem(author.Follower, user_id)
+	}
+
+	return containItem(author.Friends, user_id)
+}
+
+func (visibilityPolicy) Accepts(recipient *dataType.User, author string) bool {
+	return !containItem(recipient.BlockUser, author)
+}
+
+var (
+	fanoutLock   sync.RWMutex
+	fanoutPolicy FanoutPolicy = visibilityPolicy{}
+)
+
+//UseFanoutPolicy replaces the policy newThread and threadEdit deliver with
+func UseFanoutPolicy(p FanoutPolicy) {
+	fanoutLock.Lock()
+	defer fanoutLock.Unlock()
+
+	fanoutPolicy = p
+}
+
+func currentFanoutPolicy() FanoutPolicy {
+	fanoutLock.RLock()
+	defer fanoutLock.RUnlock()
+
+	return fanoutPolicy
+}
+
+//deliverThread puts the thread in the unread list of user_id if the policy lets it
+//it reports whether the thread was delivered, a user who left is skipped
+func deliverThread(action string, userBucket connectionHandler.Bucket, policy FanoutPolicy, user_id, author_id, thread_id string) (bool, error) {
+	var user dataType.User
+	var delivered bool
+	var unreadTrimmed, readedTrimmed int
+	err := updateDocument(action, userBucket, user_id, &user, func() error {
+		delivered = policy.Accepts(&user, author_id)
+		unreadTrimmed, readedTrimmed = 0, 0
+		if delivered {
+			user.UnreadThread = appendUnique(user.UnreadThread, thread_id)
+			unreadTrimmed, readedTrimmed = capThreadLists(&user)
+		}
+		return nil
+	})
+	if err == nil {
+		countTrim("unread:cap", unreadTrimmed)
+		countTrim("readed:cap", readedTrimmed)
+	}
+	//a reader who left must not stop the post
+	if ErrorKindOf(err) == NotFound {
+		log.Printf("skipping unread thread %s for missing user %q", thread_id, user_id)
+		return false, nil
+	}
+
+	return delivered, err
+}
+
+//removeUnread takes the thread out of both thread lists of user_id
+func removeUnread(action string, userBucket connectionHandler.Bucket, user_id, thread_id string) error {
+	var user dataType.User
+	err := updateDocument(action, userBucket, user_id, &user, func() error {
+		user.UnreadThread = removeItem(user.UnreadThread, thread_id)
+		user.ReadedThread = removeItem(user.ReadedThread, thread_id)
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+
+	return err
+}
+
+var fanoutBatchSize = flag.Int("fanoutBatch", 100, "recipients per fanoutUnread or fanoutRevoke message")
+
+func init() {
+	for _, action := range []string{`fanoutUnread`, `fanoutRevoke`} {
+		RegisterAction(action, func() interface{} { return &dataType.FanoutRequest{} }, fanoutHandler)
+	}
+}
+
+//Publisher queues follow-up messages for the workers
+type Publisher interface {
+	Enqueue(messageId string, body []byte) error
+}
+
+var (
+	publisherLock sync.RWMutex
+	publisher     Publisher
+)
+
+//UsePublisher sets where fan-out batches are queued, without one they run inline
+func UsePublisher(p Publisher) {
+	publisherLock.Lock()
+	defer publisherLock.Unlock()
+
+	publisher = p
+}
+
+func currentPublisher() Publisher {
+	publisherLock.RLock()
+	defer publisherLock.RUnlock()
+
+	return publisher
+}
+
+//fanoutBatches splits the recipients into batches of -fanoutBatch users, add and revoke batches are numbered together
+func fanoutBatches(round, thread_id string, add, revoke []string) []dataType.FanoutRequest {
+	size := *fanoutBatchSize
+	if size < 1 || size > dataType.MaxFanoutBatch {
+		size = dataType.MaxFanoutBatch
+	}
+
+	var batches []dataType.FanoutRequest
+	for _, list := range []struct {
+		action string
+		users  []string
+	}{{`fanoutUnread`, add}, {`fanoutRevoke`, revoke}} {
+		for start := 0; start < len(list.users); start += size {
+			end := start + size
+			if end > len(list.users) {
+				end = len(list.users)
+			}
+
+			batches = append(batches, dataType.FanoutRequest{
+				Thread_id: thread_id,
+				Action:    list.action,
+				Round:     round,
+				Batch:     len(batches),
+				Users:     list.users[start:end],
+			})
+		}
+	}
+
+	return batches
+}
+
+//startFanout records the progress of a new round on the thread and queues its batches
+//the round is the saga id, batches of an attempt and its retries share their message ids
+func startFanout(s *saga, threadBucket connectionHandler.Bucket, thread_id string, add, revoke []string) error {
+	if len(add) == 0 && len(revoke) == 0 {
+		return nil
+	}
+
+	//the batch message ids must differ between requests that share a body and so a saga id,
+	//dedup would drop the batches of the later one, retries keep the round of the first attempt
+	err := s.step("round", func() error {
+		s.set("round", s.record.Id+":"+strconv.FormatInt(time.Now().UnixNano(), 36))
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	round := s.get("round")
+	batches := fanoutBatches(round, thread_id, add, revoke)
+
+	err = s.step("fanout", func() error {
+		var thread dataType.Thread
+		return updateDocument(s.req.Action, threadBucket, thread_id, &thread, func() error {
+			thread.Fanout = &dataType.FanoutProgress{Round: round, Batches: len(batches)}
+			return nil
+		})
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		batch := batch
+
+		err = s.step("batch:"+strconv.Itoa(batch.Batch), func() error {
+			return enqueueRequest(batch.Action, batch.Round+":"+strconv.Itoa(batch.Batch), &batch)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//enqueueRequest queues a follow-up request with the current publisher, or runs it right away without one
+//messageId must be the same for every attempt that queues the same work
+func enqueueRequest(action, messageId string, payload interface{}) error {
+	p := currentPublisher()
+	if p == nil {
+		entry, _ := lookupAction(action)
+		return runRequest(entry, &Request{Action: action, MessageId: messageId, Payload: payload})
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return newRequestError(BadPayload, "Failed to encode %q request (%s)", action, err)
+	}
+
+	body, err := json.Marshal(dataType.Envelope{
+		Version:   dataType.CurrentVersion,
+		Action:    action,
+		MessageId: messageId,
+		Timestamp: time.Now().Unix(),
+		Payload:   encoded,
+	})
+	if err != nil {
+		return newRequestError(BadPayload, "Failed to encode %q request (%s)", action, err)
+	}
+
+	err = p.Enqueue(messageId, body)
+	if err != nil {
+		return newRequestError(StorageFailure, "Failed to queue %q request %s (%s)", action, messageId, err)
+	}
+
+	return nil
+}
+
+//fanoutHandler delivers or revokes one batch
+//the policy is checked against the thread as it is now, so a batch of an older round that
+//arrives late cannot undo a later edit
+func fanoutHandler(req *Request) error {
+	request := req.Payload.(*dataType.FanoutRequest)
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	timelineBucket, err := connectionHandler.GetBucket("Timeline")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var thread dataType.Thread
+	err = threadBucket.Get(request.Thread_id, &thread)
+	//deleted meanwhile, threadDelete cleans up the users
+	if connectionHandler.IsNotFound(err) || (err == nil && thread.Deleted) {
+		return nil
+	}
+	if err != nil {
+		return storageError(err, "Failed to get thread %s", request.Thread_id)
+	}
+
+	var author dataType.User
+	err = userBucket.Get(thread.Author, &author)
+	if err != nil {
+		return storageError(err, "Failed to get author of thread %s", request.Thread_id)
+	}
+
+	policy := currentFanoutPolicy()
+	candidates := itemSet(policy.Candidates(&author, &thread))
+	add := req.Action == `fanoutUnread`
+	entry := dataType.TimelineEntry{Thread_id: thread.Id, Author: thread.Author, Time: thread.Time}
+
+	var changed []string
+	for _, user_id := range request.Users {
+		if candidates[user_id] != add {
+			continue
+		}
+
+		if add {
+			delivered, err := deliverThread(req.Action, userBucket, policy, user_id, thread.Author, thread.Id)
+			if err != nil {
+				return err
+			}
+			if !delivered {
+				continue
+			}
+			err = addToTimeline(req.Action, timelineBucket, user_id, entry)
+		} else {
+			err = removeUnread(req.Action, userBucket, user_id, thread.Id)
+			if err == nil {
+				err = removeFromTimeline(req.Action, timelineBucket, user_id, thread.Id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		changed = append(changed, user_id)
+	}
+
+	//their lists grew, compaction trims them by age later
+	if add {
+		err = markDirty(req.Action, changed)
+		if err != nil {
+			return err
+		}
+	}
+
+	var complete bool
+	err = updateDocument(req.Action, threadBucket, thread.Id, &thread, func() error {
+		complete = false
+		for _, user_id := range changed {
+			thread.Audience, _ = toggleItem(thread.Audience, user_id, add)
+		}
+
+		progress := thread.Fanout
+		if progress == nil || progress.Round != request.Round {
+			return nil
+		}
+		for _, batch := range progress.Done {
+			if batch == request.Batch {
+				return nil
+			}
+		}
+		progress.Done = append(progress.Done, request.Batch)
+		complete = progress.Complete()
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+	if err == nil && complete {
+		log.Printf("fan-out %q of thread %s complete", request.Round, thread.Id)
+	}
+
+	return err
+}
@@ -0,0 +1,100 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"testing"
+)
+
+//blockUser makes user_id block blocked, the way a report does
+func blockUser(t *testing.T, user_id, blocked string) {
+	user := getUser(t, user_id)
+	user.BlockUser = appendUnique(user.BlockUser, blocked)
+	setDoc(t, "User", user_id, user)
+}
+
+//visibilityUsers gives alice the friends bob, dave and erin and the mere follower carol,
+//alice blocks dave and erin blocks alice
+func visibilityUsers(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob", "dave", "erin")
+	process(t, `{"action":"userRegister","Id":"carol"}`)
+	process(t, `{"action":"friendAdd","user":"carol","friendList":["alice"]}`)
+
+	blockUser(t, "alice", "dave")
+	blockUser(t, "erin", "alice")
+}
+
+func TestVisibilityPolicyCandidates(t *testing.T) {
+	author := &dataType.User{
+		Id:        "alice",
+		Friends:   []string{"bob", "dave", "bob"},
+		Follower:  []string{"bob", "carol", "alice", "dave"},
+		BlockUser: []string{"dave"},
+	}
+
+	policy := visibilityPolicy{}
+	sameList(t, "private candidates", policy.Candidates(author, &dataType.Thread{Public: "false"}), "bob")
+	sameList(t, "public candidates", policy.Candidates(author, &dataType.Thread{Public: "true"}), "bob", "carol")
+
+	if !policy.Reaches(author, &dataType.Thread{Public: "true"}, "carol") || policy.Reaches(author, &dataType.Thread{Public: "false"}, "carol") {
+		t.Fatal("carol follows alice without being a friend, she is reached by public threads only")
+	}
+	if policy.Reaches(author, &dataType.Thread{Public: "true"}, "dave") || policy.Reaches(author, &dataType.Thread{Public: "true"}, "alice") {
+		t.Fatal("the blocked user or the author is reached")
+	}
+
+	if policy.Accepts(&dataType.User{Id: "erin", BlockUser: []string{"alice"}}, "alice") {
+		t.Fatal("erin accepts a thread of alice she blocked")
+	}
+}
+
+func TestPublicThreadReachesFollowers(t *testing.T) {
+	visibilityUsers(t)
+
+	process(t, `{"action":"newThread","author":"alice","content":"hello","is_public":"true","pub_date":100}`)
+
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "1")
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread, "1")
+	sameList(t, "dave unreadThread", getUser(t, "dave").UnreadThread)
+	sameList(t, "erin unreadThread", getUser(t, "erin").UnreadThread)
+	sameList(t, "audience", getThread(t, "1").Audience, "bob", "carol")
+}
+
+func TestPrivateThreadReachesFriends(t *testing.T) {
+	visibilityUsers(t)
+
+	process(t, `{"action":"newThread","author":"alice","content":"hello","is_public":"false","pub_date":100}`)
+
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "1")
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread)
+	sameList(t, "dave unreadThread", getUser(t, "dave").UnreadThread)
+	sameList(t, "erin unreadThread", getUser(t, "erin").UnreadThread)
+	sameList(t, "audience", getThread(t, "1").Audience, "bob")
+}
+
+//requests without a message id share a saga id when their bodies match, their batches must not
+func TestIdenticalNewThreadsBothFanOut(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	body := `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`
+	process(t, body)
+	process(t, body)
+
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "1", "2")
+}
+
+func TestRepeatedThreadEditFansOutAgain(t *testing.T) {
+	visibilityUsers(t)
+	process(t, `{"action":"newThread","author":"alice","content":"hello","is_public":"false","pub_date":100}`)
+
+	public := `{"action":"threadEdit","thread_id":"1","user":"alice","is_public":"true"}`
+	process(t, public)
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread, "1")
+
+	process(t, `{"action":"threadEdit","thread_id":"1","user":"alice","is_public":"false"}`)
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread)
+
+	process(t, public)
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread, "1")
+}
@@ -0,0 +1,24 @@
+package requestHandler
+
+import (
+	"hash/fnv"
+)
+
+//payloads implementing partitioner are handled in order with every other payload of the same key
+type partitioner interface {
+	PartitionKey() string
+}
+
+func partitionKey(payload interface{}) string {
+	if p, ok := payload.(partitioner); ok {
+		return p.PartitionKey()
+	}
+
+	return ""
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,200 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"flag"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var pullThreshold = flag.Int("pullThreshold", 5000, "followers above which the threads of an author are pulled by readers instead of pushed, 0 always pushes")
+
+//pull authors are kept in the Timeline bucket, ':' never appears in a user id
+const pullAuthorsKey = "pull:authors"
+
+func postsKey(author string) string {
+	return "posts:" + author
+}
+
+var (
+	fanoutModeLock   sync.Mutex
+	fanoutModeCounts = make(map[string]uint64)
+)
+
+//FanoutModeCounts returns the number of new threads delivered by push and by pull since the worker started
+func FanoutModeCounts() map[string]uint64 {
+	fanoutModeLock.Lock()
+	defer fanoutModeLock.Unlock()
+
+	counts := make(map[string]uint64, len(fanoutModeCounts))
+	for mode, count := range fanoutModeCounts {
+		counts[mode] = count
+	}
+
+	return counts
+}
+
+func countFanoutMode(mode string) {
+	fanoutModeLock.Lock()
+	defer fanoutModeLock.Unlock()
+
+	fanoutModeCounts[mode]++
+}
+
+func usePull(author *dataType.User) bool {
+	return *pullThreshold > 0 && len(author.Follower) > *pullThreshold
+}
+
+//startPull records a thread only on the author's side, readers pick it up in ReadTimeline
+func startPull(s *saga, threadBucket connectionHandler.Bucket, thread *dataType.Thread) error {
+	timelineBucket, err := connectionHandler.GetBucket("Timeline")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	return s.step("pull", func() error {
+		var stored dataType.Thread
+		err := updateDocument(s.req.Action, threadBucket, thread.Id, &stored, func() error {
+			stored.Pull = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = addToTimeline(s.req.Action, timelineBucket, postsKey(thread.Author), dataType.TimelineEntry{
+			Thread_id: thread.Id,
+			Author:    thread.Author,
+			Time:      thread.Time,
+			Public:    thread.IsPublic(),
+		})
+		if err != nil {
+			return err
+		}
+
+		var authors dataType.PullAuthors
+		return upsertDocument(s.req.Action, timelineBucket, pullAuthorsKey, &authors, dataType.PullAuthors{}, func() error {
+			authors.Authors = appendUnique(authors.Authors, thread.Author)
+			return nil
+		})
+	}, nil)
+}
+
+//setPostVisibility updates the visibility of a pull thread after threadEdit
+func setPostVisibility(action, author, thread_id string, public bool) error {
+	timelineBucket, err := connectionHandler.GetBucket("Timeline")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var posts dataType.Timeline
+	err = updateDocument(action, timelineBucket, postsKey(author), &posts, func() error {
+		for i := range posts.Entries {
+			if posts.Entries[i].Thread_id == thread_id {
+				posts.Entries[i].Public = public
+			}
+		}
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+
+	return err
+}
+
+//pulledEntries returns the threads of the pull authors user_id follows that the fan-out policy
+//would have delivered to the user
+func pulledEntries(timelineBucket connectionHandler.Bucket, user_id string) ([]dataType.TimelineEntry, error) {
+	var authors dataType.PullAuthors
+	err := timelineBucket.Get(pullAuthorsKey, &authors)
+	if connectionHandler.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError(err, "Failed to get pull authors")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return nil, storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var reader dataType.User
+	err = userBucket.Get(user_id, &reader)
+	if connectionHandler.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError(err, "Failed to get user %q", user_id)
+	}
+
+	policy := currentFanoutPolicy()
+
+	var entries []dataType.TimelineEntry
+	for _, author_id := range authors.Authors {
+		if !containItem(reader.Following, author_id) || !policy.Accepts(&reader, author_id) {
+			continue
+		}
+
+		var author dataType.User
+		err = userBucket.Get(author_id, &author)
+		if connectionHandler.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, storageError(err, "Failed to get user %q", author_id)
+		}
+
+		var posts dataType.Timeline
+		err = timelineBucket.Get(postsKey(author_id), &posts)
+		if connectionHandler.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, storageError(err, "Failed to get threads of %q", author_id)
+		}
+
+		visible := map[bool]bool{}
+		for _, public := range []bool{true, false} {
+			visible[public] = policy.Reaches(&author, &dataType.Thread{Public: strconv.FormatBool(public)}, user_id)
+		}
+
+		for _, entry := range posts.Entries {
+			if visible[entry.Public] {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+type byTimeline []dataType.TimelineEntry
+
+func (a byTimeline) Len() int           { return len(a) }
+func (a byTimeline) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTimeline) Less(i, j int) bool { return entryBefore(a[i], a[j]) }
+
+//mergeEntries combines timeline entries in timeline order, a thread in both is kept once
+func mergeEntries(pushed, pulled []dataType.TimelineEntry) []dataType.TimelineEntry {
+	if len(pulled) == 0 {
+		return pushed
+	}
+
+	var merged []dataType.TimelineEntry
+	seen := make(map[string]bool, len(pushed)+len(pulled))
+	for _, list := range [][]dataType.TimelineEntry{pushed, pulled} {
+		for _, entry := range list {
+			if !seen[entry.Thread_id] {
+				seen[entry.Thread_id] = true
+				merged = append(merged, entry)
+			}
+		}
+	}
+	sort.Sort(byTimeline(merged))
+
+	return merged
+}
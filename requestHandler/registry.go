@@ -0,0 +1,108 @@
+package requestHandler
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//request passed to an action handler
+//Payload is the value returned by the action's payload constructor, filled from Body
+//handlers that create a document set Result to its id, it is sent back to the producer
+//handlers that read set Data, it is sent back as the data of the reply
+//FinalAttempt is set when a failure of this attempt is not retried, not even a transient one
+type Request struct {
+	Action       string
+	MessageId    string
+	Body         []byte
+	Payload      interface{}
+	Result       string
+	Data         json.RawMessage
+	FinalAttempt bool
+}
+
+type ActionHandler func(req *Request) error
+
+//payloads implementing validator are checked before their handler runs,
+//the rules live with the types in dataType
+type validator interface {
+	Validate(action string) error
+}
+
+type actionEntry struct {
+	newPayload  func() interface{}
+	handler     ActionHandler
+	maxAttempts int
+}
+
+var maxAttempts = flag.Int("maxAttempts", 5, "default number of attempts for a failing request before it is dead-lettered")
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]actionEntry)
+)
+
+//RegisterAction binds an action name to its handler
+//newPayload must return a pointer that the message body is decoded into
+//call it from init() so the action is known before the consumer starts
+func RegisterAction(action string, newPayload func() interface{}, handler ActionHandler) {
+	if action == "" || newPayload == nil || handler == nil {
+		panic("requestHandler: RegisterAction needs an action, a payload constructor and a handler")
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exist := registry[action]; exist {
+		panic(fmt.Sprintf("requestHandler: action %q registered twice", action))
+	}
+
+	registry[action] = actionEntry{newPayload: newPayload, handler: handler}
+}
+
+//SetMaxAttempts overrides -maxAttempts for one registered action
+func SetMaxAttempts(action string, attempts int) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	entry, exist := registry[action]
+	if !exist {
+		panic(fmt.Sprintf("requestHandler: SetMaxAttempts on unregistered action %q", action))
+	}
+
+	entry.maxAttempts = attempts
+	registry[action] = entry
+}
+
+//RegisteredActions returns the registered action names in sorted order
+func RegisteredActions() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	actions := make([]string, 0, len(registry))
+	for action := range registry {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	return actions
+}
+
+func lookupAction(action string) (actionEntry, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	entry, exist := registry[action]
+	return entry, exist
+}
+
+func attemptsFor(action string) int {
+	entry, exist := lookupAction(action)
+	if exist && entry.maxAttempts > 0 {
+		return entry.maxAttempts
+	}
+
+	return *maxAttempts
+}
@@ -4,80 +4,278 @@ import (
 	"../connectionHandler"
 	"../dataType"
 	"encoding/json"
+	"flag"
 	"github.com/streadway/amqp"
 	"log"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 	//"database/sql"
 	//_ "github.com/go-sql-driver/mysql"
 )
 
-func RouteRequest(deliveries <-chan amqp.Delivery, done chan error) {
+func init() {
+	RegisterAction(`newThread`, func() interface{} { return &dataType.Thread{} }, newThread)
+	RegisterAction(`commentAdd`, func() interface{} { return &dataType.Comment{} }, addComment)
+	RegisterAction(`userRegister`, func() interface{} { return &dataType.User{} }, registerUser)
+
+	for _, action := range []string{`threadLike`, `threadUnlike`, `threadReport`, `threadBlock`} {
+		RegisterAction(action, func() interface{} { return &dataType.ThreadRequest{} }, threadRequestHandler)
+	}
+
+	for _, action := range []string{`commentLike`, `commentUnlike`, `commentReport`, `commentBlock`} {
+		RegisterAction(action, func() interface{} { return &dataType.CommentRequest{} }, commentRequestHandler)
+	}
+
+	for _, action := range []string{`friendAdd`, `friendDelete`} {
+		RegisterAction(action, func() interface{} { return &dataType.UserRequest{} }, friendRelationHandler)
+	}
+}
+
+var (
+	workerCount      = flag.Int("workers", 4, "number of goroutines handling requests concurrently")
+	inlineRetries    = flag.Int("inlineRetries", 2, "times a worker retries a transient failure itself before the request goes to a retry queue")
+	inlineRetryDelay = flag.Duration("inlineRetryDelay", 200*time.Millisecond, "wait before the first in-place retry, doubled for each one after")
+)
+
+//requests waiting for a busy worker before the dispatcher blocks
+const partitionBuffer = 16
+
+type job struct {
+	d     amqp.Delivery
+	req   *Request
+	entry actionEntry
+}
+
+//RouteRequest dispatches deliveries to the workers by partition key,
+//requests for the same entity always go to the same worker and are handled in delivery order
+//a transient failure is retried in place first, so later requests of the key wait for it.
+//only once -inlineRetries are used up does it go to a retry queue, and from then on requests
+//of the same key that arrive later may be applied before it
+func RouteRequest(consumer *connectionHandler.RabbitmqConsumer, deliveries <-chan amqp.Delivery, done chan error) {
+	workers := *workerCount
+	if workers < 1 {
+		workers = 1
+	}
+
+	//fan-out batches go back to the queue this consumer reads
+	UsePublisher(consumer)
+
+	var wg sync.WaitGroup
+	partitions := make([]chan job, workers)
+	for i := range partitions {
+		partitions[i] = make(chan job, partitionBuffer)
+
+		wg.Add(1)
+		go func(jobs <-chan job) {
+			defer wg.Done()
+			for j := range jobs {
+				final := !connectionHandler.WillRetry(j.d, attemptsFor(j.req.Action))
+				settleDelivery(consumer, j.d, j.req, retryInPlace(j.entry, j.req, final))
+			}
+		}(partitions[i])
+	}
+
+	log.Printf("handling requests with %d workers", workers)
+
+	next := 0
 	for d := range deliveries {
-		//check request actionType
-		type ActionType struct {
-			Action string `json:"action"`
+		req, entry, err := decodeDelivery(d)
+		if err != nil {
+			settleDelivery(consumer, d, req, err)
+			continue
 		}
 
-		var actionType ActionType
-		err := json.Unmarshal(d.Body, &actionType)
-		if err != nil {
-			log.Println("error:", err)
+		//requests without a key have no ordering constraint, spread them round robin
+		var index int
+		if key := partitionKey(req.Payload); key != "" {
+			index = int(hashKey(key) % uint32(workers))
+		} else {
+			index = next % workers
+			next++
 		}
 
-		//route request
-		switch actionType.Action {
-		case `newThread`:
-			newThread(d.Body)
+		partitions[index] <- job{d: d, req: req, entry: entry}
+	}
+
+	for _, jobs := range partitions {
+		close(jobs)
+	}
+	wg.Wait()
+
+	log.Printf("handle: deliveries channel closed")
+	done <- nil
+}
+
+func settleDelivery(consumer *connectionHandler.RabbitmqConsumer, d amqp.Delivery, req *Request, err error) {
+	action := req.Action
 
-		case `threadLike`, `threadUnlike`, `threadReport`, `threadBlock`:
-			threadRequestHandler(d.Body)
+	if err == nil {
+		sendReply(consumer, d, req, nil)
+		d.Ack(false)
+		return
+	}
 
-		case `commentAdd`:
-			addComment(d.Body)
+	log.Printf("failed to process %q request: %s", action, err)
 
-		case `commentLike`, `commentUnlike`, `commentReport`, `commentBlock`:
-			commentRequestHandler(d.Body)
+	//the producer only hears about failures that will not be retried
+	attempts := attemptsFor(action)
+	if !isTransient(err) || !connectionHandler.WillRetry(d, attempts) {
+		sendReply(consumer, d, req, err)
+	}
 
-		case `friendAdd`, `friendDelete`:
-			friendRelationHandler(d.Body)
+	//transient errors are retried with backoff, everything else goes to the dead-letter queue
+	kind := ErrorKindOf(err).String()
+	if isTransient(err) {
+		err = consumer.Retry(d, attempts, kind, err.Error())
+	} else {
+		err = consumer.DeadLetter(d, kind, err.Error())
+	}
+	if err != nil {
+		log.Printf("failed to settle %q request: %s", action, err)
+	}
+}
 
-		case `userRegister`:
-			registerUser(d.Body)
+//sendReply tells the producer the final outcome of a request that asked for one with ReplyTo
+func sendReply(consumer *connectionHandler.RabbitmqConsumer, d amqp.Delivery, req *Request, err error) {
+	if d.ReplyTo == "" {
+		return
+	}
 
-		default:
-			log.Printf("unknown actionType")
+	reply := dataType.Reply{Action: req.Action, Status: "ok", Id: req.Result, Data: req.Data}
+	if err != nil {
+		reply.Status = "error"
+		reply.ErrorCode = ErrorKindOf(err).Code()
+		reply.Error = err.Error()
+	}
+
+	body, err := json.Marshal(reply)
+	if err == nil {
+		err = consumer.Reply(d, body)
+	}
+	if err != nil {
+		log.Printf("failed to reply to %q request: %s", req.Action, err)
+	}
+}
+
+//the returned request is never nil, its Action is set as soon as it is known
+func decodeDelivery(d amqp.Delivery) (*Request, actionEntry, error) {
+	req := &Request{MessageId: d.MessageId, Body: d.Body}
+
+	envelope, err := decodeEnvelope(d.Body)
+	req.Action = envelope.Action
+	if err != nil {
+		return req, actionEntry{}, err
+	}
+
+	//producers that cannot set the amqp message-id put it in the message
+	if req.MessageId == "" {
+		req.MessageId = envelope.MessageId
+	}
+
+	//route request
+	entry, exist := lookupAction(req.Action)
+	if !exist {
+		return req, entry, newRequestError(BadPayload, "unknown actionType")
+	}
+
+	req.Payload = entry.newPayload()
+	err = json.Unmarshal(envelope.Payload, req.Payload)
+	if err != nil {
+		return req, entry, newRequestError(BadPayload, "Failed to decode payload (%s)", err)
+	}
+
+	if v, ok := req.Payload.(validator); ok {
+		err = v.Validate(req.Action)
+		if err != nil {
+			return req, entry, &RequestError{Kind: Invalid, Err: err}
 		}
+	}
 
-		d.Ack(false)
+	return req, entry, nil
+}
+
+//ProcessMessage decodes body and runs its handler like RouteRequest does, without a broker
+func ProcessMessage(body []byte) error {
+	req, entry, err := decodeDelivery(amqp.Delivery{Body: body})
+	if err != nil {
+		return err
 	}
 
-	log.Printf("handle: deliveries channel closed")
-	done <- nil
+	return runRequest(entry, req)
+}
+
+//retryInPlace runs the request and retries transient failures without giving up its place in the partition
+//final tells that the delivery is dead-lettered when this fails, the last attempt then rolls back
+func retryInPlace(entry actionEntry, req *Request, final bool) error {
+	req.FinalAttempt = final && *inlineRetries <= 0
+	err := runRequest(entry, req)
+
+	wait := *inlineRetryDelay
+	for retry := 0; retry < *inlineRetries && err != nil && isTransient(err); retry++ {
+		log.Printf("retrying %q request in %s: %s", req.Action, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+
+		req.FinalAttempt = final && retry == *inlineRetries-1
+		err = runRequest(entry, req)
+	}
+
+	return err
 }
 
-func registerUser(msg []byte) {
-	var newUser dataType.User
-	err := json.Unmarshal(msg, &newUser)
+//runRequest skips requests that were already processed and remembers the ones that succeed
+func runRequest(entry actionEntry, req *Request) error {
+	processed, err := isProcessed(req)
 	if err != nil {
-		log.Println("error:", err)
+		return err
+	}
+
+	if processed {
+		log.Printf("skipping %q request %q, already processed", req.Action, req.MessageId)
+		return nil
+	}
+
+	err = callHandler(entry, req)
+	if err == nil {
+		markProcessed(req)
 	}
 
+	return err
+}
+
+//a failed request must never stop the consumer, so panics are returned as errors too
+func callHandler(entry actionEntry, req *Request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newRequestError(BadPayload, "handler panicked (%v)", r)
+		}
+	}()
+
+	return entry.handler(req)
+}
+
+func registerUser(req *Request) error {
+	newUser := req.Payload.(*dataType.User)
+
 	bucket, err := connectionHandler.GetBucket("User")
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
 	added, err := bucket.Add(newUser.Id, 0, newUser)
 	if err != nil {
-		log.Fatalf("Failed to register new user (%s)\n", err)
+		return storageError(err, "Failed to register new user")
 	}
 
 	if !added {
-		log.Fatalf("A User with the same id of (%s) already exists.\n", newUser.Id)
+		return newRequestError(Conflict, "A User with the same id of (%s) already exists", newUser.Id)
 	}
 
-	defer bucket.Close()
+	req.Result = newUser.Id
+
+	return nil
 }
 
 /////////for sorting
@@ -88,100 +286,91 @@ func (a ByString) Len() int           { return len(a) }
 func (a ByString) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByString) Less(i, j int) bool { return a[i] < a[j] }
 
-/////////for sorting
+//list must be sorted
+func removeDuplicate(list []string) []string {
+	if len(list) == 0 {
+		return list
+	}
 
-func friendRelationHandler(msg []byte) {
-	var request dataType.UserRequest
-	err := json.Unmarshal(msg, &request)
-	if err != nil {
-		log.Println("error:", err)
+	unique := list[:1]
+	for _, item := range list[1:] {
+		if item != unique[len(unique)-1] {
+			unique = append(unique, item)
+		}
 	}
 
-	///////////////////
+	return unique
+}
 
-	var user dataType.User
+/////////for sorting
 
-	userBucket, err := connectionHandler.GetBucket("User")
-	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+func containItem(list []string, item string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
 	}
 
-	err = userBucket.Get(request.User, &user)
-	if err != nil {
-		log.Fatalf("Failed to get user to change property (%s)\n", err)
-	}
+	return false
+}
 
-	///////////////////
+//itemSet indexes list for lookups in loops, containItem is linear
+func itemSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		set[item] = true
+	}
 
-	switch request.Action {
-	case `friendAdd`:
-		for _, friend_id := range request.FriendList {
-			user.Following = append(user.Following, friend_id)
+	return set
+}
 
-			var friend dataType.User
-			err = userBucket.Get(friend_id, &friend)
-			if err != nil {
-				log.Fatalf("Failed to get user to change property (%s)\n", err)
-			}
+//appendUnique appends item unless list already has it
+func appendUnique(list []string, item string) []string {
+	if containItem(list, item) {
+		return list
+	}
 
-			friend.Follower = append(friend.Follower, user.Id)
+	return append(list, item)
+}
 
-			//update change
-			err = userBucket.Set(friend.Id, 0, friend)
-			if err != nil {
-				log.Fatalf("Failed to re-write user to add writeThread (%s)\n", err)
-			}
+//removeItem removes every occurrence of item from list
+func removeItem(list []string, item string) []string {
+	kept := list[:0]
+	for _, listItem := range list {
+		if listItem != item {
+			kept = append(kept, listItem)
 		}
-	case `friendDelete`:
-		for _, friend_id := range request.FriendList {
-			for i, userFollowing := range user.Following {
-				if userFollowing == friend_id {
-					user.Following = append(user.Following[:i], user.Following[i+1:]...)
-					break
-				}
-			}
+	}
 
-			var friend dataType.User
-			/////////친구의 팔로잉 제거
-			err = userBucket.Get(friend_id, &friend)
-			if err != nil {
-				log.Fatalf("Failed to get user to change property (%s)\n", err)
-			}
+	return kept
+}
 
-			for i, friendFollower := range friend.Follower {
-				if friendFollower == friend_id {
-					friend.Follower = append(friend.Follower[:i], friend.Follower[i+1:]...)
-					break
-				}
-			}
+//toggleItem adds or removes item and reports whether list changed
+func toggleItem(list []string, item string, add bool) ([]string, bool) {
+	if containItem(list, item) == add {
+		return list, false
+	}
 
-			//update change
-			err = userBucket.Set(friend.Id, 0, friend)
-			if err != nil {
-				log.Fatalf("Failed to re-write user to add writeThread (%s)\n", err)
-			}
-		}
+	if add {
+		return append(list, item), true
 	}
 
+	return removeItem(list, item), true
+}
+
+//syncFriends rebuilds Friends as the users found in both Follower and Following
+func syncFriends(user *dataType.User) {
 	///////////////friend 동기화
 	// 0. 소팅
 	sort.Sort(ByString(user.Following))
 	sort.Sort(ByString(user.Follower))
 	// 1. 중복제거
-	for i, listUser := range user.Following {
-		if user.Following[i] == user.Following[i+1] {
-			user.Following = append(user.Following[:i], user.Following[i+1:]...)
-		}
-	}
-	for i, listUser := range user.Follower {
-		if user.Follower[i] == user.Follower[i+1] {
-			user.Follower = append(user.Follower[:i], user.Follower[i+1:]...)
-		}
-	}
+	user.Following = removeDuplicate(user.Following)
+	user.Follower = removeDuplicate(user.Follower)
 	// 2. friend 리스트 만들기
 	i := 0
 	j := 0
-	user.Friend = user.Friend[:0]
+	user.Friends = user.Friends[:0]
 
 	for i < len(user.Follower) && j < len(user.Following) {
 		if user.Follower[i] > user.Following[j] {
@@ -189,397 +378,490 @@ func friendRelationHandler(msg []byte) {
 		} else if user.Follower[i] < user.Following[j] {
 			i++
 		} else {
-			user.Friend = append(user.Friend, user.Follower[i])
+			user.Friends = append(user.Friends, user.Follower[i])
 			i++
 			j++
 		}
 	}
+}
+
+func friendRelationHandler(req *Request) error {
+	request := req.Payload.(*dataType.UserRequest)
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
 
-	err = userBucket.Set(user.Id, 0, user)
+	s, err := beginSaga(req)
 	if err != nil {
-		log.Fatalf("Failed to re-write user to add writeThread (%s)\n", err)
+		return err
 	}
 
-	defer userBucket.Close()
+	/////////친구의 팔로워 변경
+	for _, friend_id := range request.FriendList {
+		friend_id := friend_id
+		stepName := "follower:" + friend_id
+
+		//whether the change applies is recorded first, a retry after the write cannot tell anymore
+		err = s.step("before:"+friend_id, func() error {
+			var friend dataType.User
+			err := userBucket.Get(friend_id, &friend)
+			if err != nil {
+				return storageError(err, "Failed to get user %q", friend_id)
+			}
+			s.set(stepName, strconv.FormatBool(changeFollower(&friend, req.Action, request.User, false)))
+			return nil
+		}, nil)
+		if err != nil {
+			return s.abort(err)
+		}
+
+		err = s.step(stepName, func() error {
+			var friend dataType.User
+			return updateDocument(req.Action, userBucket, friend_id, &friend, func() error {
+				changeFollower(&friend, req.Action, request.User, false)
+				return nil
+			})
+		}, func() error {
+			if s.get(stepName) != "true" {
+				return nil
+			}
+			var friend dataType.User
+			return updateDocument(req.Action, userBucket, friend_id, &friend, func() error {
+				changeFollower(&friend, req.Action, request.User, true)
+				return nil
+			})
+		})
+		if err != nil {
+			return s.abort(err)
+		}
+	}
+
+	/////////내 팔로잉 변경
+	var user dataType.User
+	err = updateDocument(req.Action, userBucket, request.User, &user, func() error {
+		for _, friend_id := range request.FriendList {
+			user.Following, _ = toggleItem(user.Following, friend_id, req.Action == `friendAdd`)
+		}
+		syncFriends(&user)
+		return nil
+	})
+	if err != nil {
+		return s.abort(err)
+	}
+
+	return s.finish()
 }
 
-func increaseBucketKey(bucketName string) string {
+//changeFollower applies friendAdd or friendDelete of follower to user, or reverts it when undo is set
+func changeFollower(user *dataType.User, action, follower string, undo bool) bool {
+	var changed bool
+	user.Follower, changed = toggleItem(user.Follower, follower, (action == `friendAdd`) != undo)
+	syncFriends(user)
+	return changed
+}
+
+func increaseBucketKey(bucketName string) (string, error) {
 	bucket, err := connectionHandler.GetBucket(bucketName)
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return "", storageError(err, "Failed to get bucket from couchbase")
 	}
 
 	bucketKey := bucketName + "Num"
 
 	key, err := bucket.Incr(bucketKey, 1, 1, 0)
 	if err != nil {
-		log.Fatalf("Failed to get bucketKey (%s)\n", err)
+		return "", storageError(err, "Failed to get bucketKey")
 	}
 
-	defer bucket.Close()
-
-	return strconv.FormatUint(key, 10)
+	return strconv.FormatUint(key, 10), nil
 }
 
-func newThread(msg []byte) {
-	var thread dataType.Thread
-	err := json.Unmarshal(msg, &thread)
-	if err != nil {
-		log.Println("error:", err)
+//deleteDocument removes key, a key that is already gone is not an error
+func deleteDocument(bucket connectionHandler.Bucket, key string) error {
+	err := bucket.Delete(key)
+	if err != nil && !connectionHandler.IsNotFound(err) {
+		return storageError(err, "Failed to delete document %q", key)
 	}
 
-	thread.Id = increaseBucketKey("Thread")
+	return nil
+}
+
+func newThread(req *Request) error {
+	thread := req.Payload.(*dataType.Thread)
 
 	threadBucket, err := connectionHandler.GetBucket("Thread")
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	added, err := threadBucket.Add(thread.Id, 0, thread)
+	userBucket, err := connectionHandler.GetBucket("User")
 	if err != nil {
-		log.Fatalf("Failed to write new thread (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	if !added {
-		log.Fatalf("A Thread with the same id of (%s) already exists.\n", thread.Id)
+	s, err := beginSaga(req)
+	if err != nil {
+		return err
 	}
 
-	var user dataType.User
-
-	userBucket, err := connectionHandler.GetBucket("User")
-	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+	//producers may leave pub_date out, the first attempt picks it so retries write the same one
+	if s.get("pubDate") == "" {
+		s.set("pubDate", strconv.FormatInt(requestTime(thread.Time), 10))
 	}
-	err = userBucket.Get(thread.Author, &user)
+	thread.Time, _ = strconv.ParseInt(s.get("pubDate"), 10, 64)
+
+	err = s.step("threadId", func() error {
+		id, err := increaseBucketKey("Thread")
+		s.set("threadId", id)
+		return err
+	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to get user to add writeThread (%s)\n", err)
+		return s.abort(err)
 	}
+	thread.Id = s.get("threadId")
+	req.Result = thread.Id
 
-	user.WriteThread = append(user.WriteThread, thread.Id)
-
-	for _, friend_id := range user.Friends {
-		var friend dataType.User
-		err = userBucket.Get(friend_id, &friend)
+	err = s.step("writeThread", func() error {
+		added, err := threadBucket.Add(thread.Id, 0, thread)
 		if err != nil {
-			log.Fatalf("Failed to get user to add unreadThread (%s)\n", err)
+			return storageError(err, "Failed to write new thread")
 		}
 
-		friend.UnreadThread = append(friend.UnreadThread, thread.Id)
-
-		err = userBucket.Set(friend.Id, 0, friend)
-		if err != nil {
-			log.Fatalf("Failed to re-write friend to add UnreadThread (%s)\n", err)
+		//the id came from this saga's Incr, so the thread is our own write of an attempt whose save failed
+		if !added {
+			log.Printf("thread %s already written by an earlier attempt", thread.Id)
 		}
-	}
 
-	//update change
-	err = userBucket.Set(user.Id, 0, user)
+		return nil
+	}, func() error {
+		return deleteDocument(threadBucket, thread.Id)
+	})
 	if err != nil {
-		log.Fatalf("Failed to re-write user to add writeThread (%s)\n", err)
+		return s.abort(err)
 	}
 
-	defer threadBucket.Close()
-	defer userBucket.Close()
-}
-
-func addComment(msg []byte) {
-	var comment dataType.Comment
-	err := json.Unmarshal(msg, &comment)
+	err = s.step("writeThreadUser", func() error {
+		var user dataType.User
+		return updateDocument(req.Action, userBucket, thread.Author, &user, func() error {
+			user.WriteThread = appendUnique(user.WriteThread, thread.Id)
+			return nil
+		})
+	}, func() error {
+		var user dataType.User
+		return updateDocument(req.Action, userBucket, thread.Author, &user, func() error {
+			user.WriteThread = removeItem(user.WriteThread, thread.Id)
+			return nil
+		})
+	})
 	if err != nil {
-		log.Println("error:", err)
+		return s.abort(err)
 	}
 
-	comment.Id = increaseBucketKey("Comment")
-
-	commentBucket, err := connectionHandler.GetBucket("Comment")
-	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
-	}
-	added, err := commentBucket.Add(comment.Id, 0, comment)
+	var user dataType.User
+	err = userBucket.Get(thread.Author, &user)
 	if err != nil {
-		log.Fatalf("Failed to write new comment (%s)\n", err)
-	}
-	if !added {
-		log.Fatalf("A Comment with the same id of (%s) already exists.\n", comment.Id)
+		return s.abort(storageError(err, "Failed to get user to add unreadThread"))
 	}
 
-	var thread dataType.Thread
+	//the mode is kept in the saga, a retry must not switch it when the follower count changed
+	if s.get("mode") == "" {
+		s.set("mode", "push")
+		if usePull(&user) {
+			s.set("mode", "pull")
+		}
+	}
 
-	threadBucket, err := connectionHandler.GetBucket("Thread")
-	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+	if s.get("mode") == "pull" {
+		err = startPull(s, threadBucket, thread)
+	} else {
+		//recipients are reached by fanoutUnread batches, a failed one does not fail the post
+		err = startFanout(s, threadBucket, thread.Id, currentFanoutPolicy().Candidates(&user, thread), nil)
 	}
-	err = threadBucket.Get(comment.Thread_id, &thread)
 	if err != nil {
-		log.Fatalf("Failed to get thread to add comment (%s)\n", err)
+		return s.abort(err)
 	}
+	countFanoutMode(s.get("mode"))
+	log.Printf("thread %s of %q delivered by %s, %d followers", thread.Id, thread.Author, s.get("mode"), len(user.Follower))
+
+	return s.finish()
+}
 
-	thread.Comment = append(thread.Comment, comment.Id)
+func addComment(req *Request) error {
+	comment := req.Payload.(*dataType.Comment)
 
-	//update change
-	err = threadBucket.Set(thread.Id, 0, thread)
+	commentBucket, err := connectionHandler.GetBucket("Comment")
 	if err != nil {
-		log.Fatalf("Failed to re-write thread to add comment (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	var user dataType.User
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
 
 	userBucket, err := connectionHandler.GetBucket("User")
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
-	err = userBucket.Get(comment.Author, &user)
+
+	s, err := beginSaga(req)
 	if err != nil {
-		log.Fatalf("Failed to get user to add writeComment (%s)\n", err)
+		return err
 	}
 
-	user.WriteComment = append(user.WriteComment, comment.Id)
-
-	//update change
-	err = userBucket.Set(user.Id, 0, user)
+	err = s.step("commentId", func() error {
+		id, err := increaseBucketKey("Comment")
+		s.set("commentId", id)
+		return err
+	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to re-write user to add writeComment (%s)\n", err)
+		return s.abort(err)
 	}
+	comment.Id = s.get("commentId")
+	req.Result = comment.Id
 
-	defer commentBucket.Close()
-	defer threadBucket.Close()
-	defer userBucket.Close()
-}
+	err = s.step("writeComment", func() error {
+		added, err := commentBucket.Add(comment.Id, 0, comment)
+		if err != nil {
+			return storageError(err, "Failed to write new comment")
+		}
+		//the id came from this saga's Incr, so the comment is our own write of an attempt whose save failed
+		if !added {
+			log.Printf("comment %s already written by an earlier attempt", comment.Id)
+		}
 
-func threadRequestHandler(msg []byte) {
-	var request dataType.ThreadRequest
-	err := json.Unmarshal(msg, &request)
+		return nil
+	}, func() error {
+		return deleteDocument(commentBucket, comment.Id)
+	})
 	if err != nil {
-		log.Println("error:", err)
+		return s.abort(err)
 	}
 
-	/////////////////
-
-	var user dataType.User
-
-	userBucket, err := connectionHandler.GetBucket("User")
+	err = s.step("threadComment", func() error {
+		var thread dataType.Thread
+		return updateDocument(req.Action, threadBucket, comment.Thread_id, &thread, func() error {
+			if thread.Deleted {
+				return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
+			}
+			thread.Comment = appendUnique(thread.Comment, comment.Id)
+			return nil
+		})
+	}, func() error {
+		var thread dataType.Thread
+		return updateDocument(req.Action, threadBucket, comment.Thread_id, &thread, func() error {
+			thread.Comment = removeItem(thread.Comment, comment.Id)
+			return nil
+		})
+	})
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return s.abort(err)
 	}
 
-	err = userBucket.Get(request.User, &user)
+	var user dataType.User
+	err = updateDocument(req.Action, userBucket, comment.Author, &user, func() error {
+		user.WriteComment = appendUnique(user.WriteComment, comment.Id)
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Failed to get user to change property (%s)\n", err)
+		return s.abort(err)
 	}
 
-	/////////////////
+	return s.finish()
+}
 
-	var thread dataType.Thread
+func threadRequestHandler(req *Request) error {
+	request := req.Payload.(*dataType.ThreadRequest)
 
-	threadBucket, err := connectionHandler.GetBucket("Thread")
+	userBucket, err := connectionHandler.GetBucket("User")
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	err = threadBucket.Get(request.Thread_id, &thread)
+	threadBucket, err := connectionHandler.GetBucket("Thread")
 	if err != nil {
-		log.Fatalf("Failed to get thread to change property (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	switch request.Action {
-	case `threadLike`:
-		var exsit bool
-		for _, userName := range thread.Like {
-			if userName == request.User {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			thread.Like = append(thread.Like, request.User)
-		}
-
-		exsit = false
-
-		for _, thread_id := range user.LikeThread {
-			if thread_id == request.Thread_id {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			user.LikeThread = append(user.LikeThread, request.Thread_id)
-		}
+	s, err := beginSaga(req)
+	if err != nil {
+		return err
+	}
 
-	case `threadUnlike`:
-		for i, userName := range thread.Like {
-			if userName == request.User {
-				thread.Like = append(thread.Like[:i], thread.Like[i+1:]...)
-				break
-			}
-		}
+	/////////////////
 
-		for i, thread_id := range user.LikeThread {
-			if thread_id == request.Thread_id {
-				user.LikeThread = append(user.LikeThread[:i], user.LikeThread[i+1:]...)
-				break
-			}
-		}
-	case `threadReport`:
-		var exsit bool
-		for _, userName := range thread.Report {
-			if userName == request.User {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			thread.Report = append(thread.Report, request.User)
-		}
-	case `threadBlock`:
-		var exsit bool
-		for _, userName := range thread.Block {
-			if userName == request.User {
-				exsit = true
-			}
+	//whether the change applies is recorded first, a retry after the write cannot tell anymore
+	err = s.step("threadBefore", func() error {
+		var thread dataType.Thread
+		err := threadBucket.Get(request.Thread_id, &thread)
+		if err != nil {
+			return storageError(err, "Failed to get thread %s", request.Thread_id)
 		}
-		if exsit != true {
-			thread.Block = append(thread.Block, request.User)
+		if thread.Deleted {
+			return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
 		}
+		s.set("thread", strconv.FormatBool(changeThread(&thread, req.Action, request.User, false)))
+		s.set("threadAuthor", thread.Author)
+		return nil
+	}, nil)
+	if err != nil {
+		return s.abort(err)
+	}
 
-		for _, thread_id := range user.BlockUser {
-			if thread_id == thread.Author {
-				exsit = true
+	err = s.step("thread", func() error {
+		var thread dataType.Thread
+		return updateDocument(req.Action, threadBucket, request.Thread_id, &thread, func() error {
+			if thread.Deleted {
+				return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
 			}
+			changeThread(&thread, req.Action, request.User, false)
+			return nil
+		})
+	}, func() error {
+		if s.get("thread") != "true" {
+			return nil
 		}
-		if exsit != true {
-			user.BlockUser = append(user.BlockUser, request.Thread_id)
-		}
-	}
-
-	//update change
-	err = threadBucket.Set(thread.Id, 0, thread)
+		var thread dataType.Thread
+		return updateDocument(req.Action, threadBucket, request.Thread_id, &thread, func() error {
+			changeThread(&thread, req.Action, request.User, true)
+			return nil
+		})
+	})
 	if err != nil {
-		log.Fatalf("Failed to re-write thread to change property (%s)\n", err)
+		return s.abort(err)
 	}
 
-	err = userBucket.Set(user.Id, 0, user)
+	/////////////////
+
+	var user dataType.User
+	err = updateDocument(req.Action, userBucket, request.User, &user, func() error {
+		switch req.Action {
+		case `threadLike`:
+			user.LikeThread = appendUnique(user.LikeThread, request.Thread_id)
+		case `threadUnlike`:
+			user.LikeThread = removeItem(user.LikeThread, request.Thread_id)
+		case `threadBlock`:
+			user.BlockUser = appendUnique(user.BlockUser, s.get("threadAuthor"))
+		}
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Failed to re-write user to add likeThread (%s)\n", err)
+		return s.abort(err)
 	}
 
-	defer threadBucket.Close()
-	defer userBucket.Close()
+	return s.finish()
 }
 
-func commentRequestHandler(msg []byte) {
-	var request dataType.CommentRequest
-	err := json.Unmarshal(msg, &request)
-	if err != nil {
-		log.Println("error:", err)
+//changeThread applies action of user to thread, or reverts it when undo is set
+func changeThread(thread *dataType.Thread, action, user string, undo bool) bool {
+	var changed bool
+
+	switch action {
+	case `threadLike`:
+		thread.Like, changed = toggleItem(thread.Like, user, !undo)
+	case `threadUnlike`:
+		thread.Like, changed = toggleItem(thread.Like, user, undo)
+	case `threadReport`:
+		thread.Report, changed = toggleItem(thread.Report, user, !undo)
+	case `threadBlock`:
+		thread.Block, changed = toggleItem(thread.Block, user, !undo)
 	}
 
-	/////////////////
+	return changed
+}
 
-	var user dataType.User
+func commentRequestHandler(req *Request) error {
+	request := req.Payload.(*dataType.CommentRequest)
 
 	userBucket, err := connectionHandler.GetBucket("User")
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	err = userBucket.Get(request.User, &user)
+	commentBucket, err := connectionHandler.GetBucket("Comment")
 	if err != nil {
-		log.Fatalf("Failed to get user to change property (%s)\n", err)
+		return storageError(err, "Failed to get bucket from couchbase")
 	}
 
-	/////////////////
+	s, err := beginSaga(req)
+	if err != nil {
+		return err
+	}
 
-	var comment dataType.Comment
+	/////////////////
 
-	commentBucket, err := connectionHandler.GetBucket("Comment")
+	//whether the change applies is recorded first, a retry after the write cannot tell anymore
+	err = s.step("commentBefore", func() error {
+		var comment dataType.Comment
+		err := commentBucket.Get(request.Comment_id, &comment)
+		if err != nil {
+			return storageError(err, "Failed to get comment %s", request.Comment_id)
+		}
+		s.set("comment", strconv.FormatBool(changeComment(&comment, req.Action, request.User, false)))
+		s.set("commentAuthor", comment.Author)
+		return nil
+	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to get bucket from couchbase (%s)\n", err)
+		return s.abort(err)
 	}
 
-	err = commentBucket.Get(request.Comment_id, &comment)
+	err = s.step("comment", func() error {
+		var comment dataType.Comment
+		return updateDocument(req.Action, commentBucket, request.Comment_id, &comment, func() error {
+			changeComment(&comment, req.Action, request.User, false)
+			return nil
+		})
+	}, func() error {
+		if s.get("comment") != "true" {
+			return nil
+		}
+		var comment dataType.Comment
+		return updateDocument(req.Action, commentBucket, request.Comment_id, &comment, func() error {
+			changeComment(&comment, req.Action, request.User, true)
+			return nil
+		})
+	})
 	if err != nil {
-		log.Fatalf("Failed to get comment to change property (%s)\n", err)
+		return s.abort(err)
 	}
 
 	/////////////////
 
-	switch request.Action {
-	case `commentLike`:
-		var exsit bool
-		for _, userName := range comment.Like {
-			if userName == request.User {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			comment.Like = append(comment.Like, request.User)
+	var user dataType.User
+	err = updateDocument(req.Action, userBucket, request.User, &user, func() error {
+		switch req.Action {
+		case `commentLike`:
+			user.LikeComment = appendUnique(user.LikeComment, request.Comment_id)
+		case `commentUnlike`:
+			user.LikeComment = removeItem(user.LikeComment, request.Comment_id)
+		case `commentBlock`:
+			user.BlockUser = appendUnique(user.BlockUser, s.get("commentAuthor"))
 		}
+		return nil
+	})
+	if err != nil {
+		return s.abort(err)
+	}
 
-		exsit = false
+	return s.finish()
+}
 
-		for _, comment_id := range user.LikeComment {
-			if comment_id == request.Comment_id {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			user.LikeComment = append(user.LikeComment, request.Comment_id)
-		}
-	case `commentUnlike`:
-		for i, userName := range comment.Like {
-			if userName == request.User {
-				comment.Like = append(comment.Like[:i], comment.Like[i+1:]...)
-				break
-			}
-		}
+//changeComment applies action of user to comment, or reverts it when undo is set
+func changeComment(comment *dataType.Comment, action, user string, undo bool) bool {
+	var changed bool
 
-		for i, comment_id := range user.LikeComment {
-			if comment_id == request.Comment_id {
-				user.LikeComment = append(user.LikeComment[:i], user.LikeComment[i+1:]...)
-			}
-		}
+	switch action {
+	case `commentLike`:
+		comment.Like, changed = toggleItem(comment.Like, user, !undo)
+	case `commentUnlike`:
+		comment.Like, changed = toggleItem(comment.Like, user, undo)
 	case `commentReport`:
-		var exsit bool
-		for _, userName := range comment.Report {
-			if userName == request.User {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			comment.Report = append(comment.Report, request.User)
-		}
+		comment.Report, changed = toggleItem(comment.Report, user, !undo)
 	case `commentBlock`:
-		var exsit bool
-		for _, userName := range comment.Block {
-			if userName == request.User {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			comment.Block = append(comment.Block, request.User)
-		}
-
-		exsit = false
-
-		for _, blockUser := range user.BlockUser {
-			if blockUser == comment.Author {
-				exsit = true
-			}
-		}
-		if exsit != true {
-			user.BlockUser = append(user.BlockUser, comment.Author)
-		}
-	}
-
-	//update change
-	err = commentBucket.Set(comment.Id, 0, comment)
-	if err != nil {
-		log.Fatalf("Failed to re-write comment to change property (%s)\n", err)
-	}
-
-	err = userBucket.Set(user.Id, 0, user)
-	if err != nil {
-		log.Fatalf("Failed to re-write user to change property (%s)\n", err)
+		comment.Block, changed = toggleItem(comment.Block, user, !undo)
 	}
 
-	defer commentBucket.Close()
-	defer userBucket.Close()
+	return changed
 }
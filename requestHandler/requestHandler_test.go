@@ -0,0 +1,183 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"reflect"
+	"testing"
+)
+
+//useMemoryStore points GetBucket at an empty store for one test
+func useMemoryStore(t *testing.T) *connectionHandler.MemoryStore {
+	store := connectionHandler.NewMemoryStore()
+	connectionHandler.UseStore(store)
+	return store
+}
+
+func process(t *testing.T, body string) {
+	if err := ProcessMessage([]byte(body)); err != nil {
+		t.Fatalf("processing %s: %s", body, err)
+	}
+}
+
+func processKind(t *testing.T, body string, kind ErrorKind) {
+	err := ProcessMessage([]byte(body))
+	if err == nil {
+		t.Fatalf("processing %s: succeeded, want %s", body, kind)
+	}
+	if ErrorKindOf(err) != kind {
+		t.Fatalf("processing %s: %s, want %s", body, err, kind)
+	}
+}
+
+func getDoc(t *testing.T, bucketname, key string, v interface{}) {
+	bucket, err := connectionHandler.GetBucket(bucketname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get(key, v); err != nil {
+		t.Fatalf("%s %q: %s", bucketname, key, err)
+	}
+}
+
+func setDoc(t *testing.T, bucketname, key string, v interface{}) {
+	bucket, err := connectionHandler.GetBucket(bucketname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Set(key, 0, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func missingDoc(t *testing.T, bucketname, key string) {
+	bucket, err := connectionHandler.GetBucket(bucketname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v interface{}
+	if err := bucket.Get(key, &v); !connectionHandler.IsNotFound(err) {
+		t.Fatalf("%s %q: got %v (%v), want it missing", bucketname, key, v, err)
+	}
+}
+
+func getUser(t *testing.T, user_id string) dataType.User {
+	var user dataType.User
+	getDoc(t, "User", user_id, &user)
+	return user
+}
+
+func getThread(t *testing.T, thread_id string) dataType.Thread {
+	var thread dataType.Thread
+	getDoc(t, "Thread", thread_id, &thread)
+	return thread
+}
+
+func sameList(t *testing.T, what string, got []string, want ...string) {
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s = %v, want %v", what, got, want)
+	}
+}
+
+//registerFriends registers the users and makes each pair of them friends
+func registerFriends(t *testing.T, users ...string) {
+	for _, user_id := range users {
+		process(t, `{"action":"userRegister","Id":"`+user_id+`"}`)
+	}
+	for _, user_id := range users {
+		for _, friend_id := range users {
+			if friend_id != user_id {
+				process(t, `{"action":"friendAdd","user":"`+user_id+`","friendList":["`+friend_id+`"]}`)
+			}
+		}
+	}
+}
+
+func TestUserRegister(t *testing.T) {
+	useMemoryStore(t)
+
+	process(t, `{"action":"userRegister","Id":"alice","registerDate":10}`)
+	if user := getUser(t, "alice"); user.RegisterDate != 10 {
+		t.Fatalf("registerDate = %d, want 10", user.RegisterDate)
+	}
+
+	processKind(t, `{"action":"userRegister","Id":"alice"}`, Conflict)
+}
+
+func TestFriendAddAndDelete(t *testing.T) {
+	useMemoryStore(t)
+
+	process(t, `{"action":"userRegister","Id":"alice"}`)
+	process(t, `{"action":"userRegister","Id":"bob"}`)
+
+	process(t, `{"action":"friendAdd","user":"alice","friendList":["bob"]}`)
+	alice, bob := getUser(t, "alice"), getUser(t, "bob")
+	sameList(t, "alice following", alice.Following, "bob")
+	sameList(t, "bob follower", bob.Follower, "alice")
+	sameList(t, "alice friends", alice.Friends)
+
+	process(t, `{"action":"friendAdd","user":"bob","friendList":["alice"]}`)
+	alice, bob = getUser(t, "alice"), getUser(t, "bob")
+	sameList(t, "alice friends", alice.Friends, "bob")
+	sameList(t, "bob friends", bob.Friends, "alice")
+
+	process(t, `{"action":"friendDelete","user":"alice","friendList":["bob"]}`)
+	alice, bob = getUser(t, "alice"), getUser(t, "bob")
+	sameList(t, "alice following", alice.Following)
+	sameList(t, "alice friends", alice.Friends)
+	sameList(t, "bob follower", bob.Follower)
+	sameList(t, "bob friends", bob.Friends)
+}
+
+func TestNewThread(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	thread := getThread(t, "1")
+	if thread.Id != "1" || thread.Content != "hello" {
+		t.Fatalf("thread = %+v", thread)
+	}
+	sameList(t, "alice writeThread", getUser(t, "alice").WriteThread, "1")
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "1")
+	sameList(t, "audience", thread.Audience, "bob")
+}
+
+func TestCommentAdd(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	process(t, `{"action":"commentAdd","thread_id":"1","author":"bob","content":"hi"}`)
+
+	var comment dataType.Comment
+	getDoc(t, "Comment", "1", &comment)
+	if comment.Author != "bob" || comment.Content != "hi" {
+		t.Fatalf("comment = %+v", comment)
+	}
+	sameList(t, "thread comments", getThread(t, "1").Comment, "1")
+	sameList(t, "bob writeComment", getUser(t, "bob").WriteComment, "1")
+}
+
+func TestCommentAddRollsBack(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	thread := getThread(t, "1")
+	thread.Deleted = true
+	setDoc(t, "Thread", "1", thread)
+
+	processKind(t, `{"action":"commentAdd","request_id":"c1","thread_id":"1","author":"bob","content":"hi"}`, NotFound)
+
+	//the comment written by the first step is compensated
+	missingDoc(t, "Comment", "1")
+	missingDoc(t, "Saga", "commentAdd:c1")
+	sameList(t, "thread comments", getThread(t, "1").Comment)
+	sameList(t, "bob writeComment", getUser(t, "bob").WriteComment)
+}
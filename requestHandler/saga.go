@@ -0,0 +1,161 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+//saga records are dropped after a week, a request not resumed by then is abandoned
+const sagaExpiry = 7 * 24 * 60 * 60
+
+const (
+	sagaRunning            = "running"
+	sagaCompensationFailed = "compensationFailed"
+)
+
+//saga runs the steps of a multi-document request and records their progress in the Saga bucket
+//a transient failure keeps the record so the retried request skips the completed steps,
+//any other failure undoes the completed steps in reverse order
+type saga struct {
+	req           *Request
+	bucket        connectionHandler.Bucket
+	record        dataType.Saga
+	compensations []func() error
+}
+
+//sagas are keyed by the message id, or by the body for messages without one
+func sagaId(req *Request) string {
+	if req.MessageId != "" {
+		return req.Action + ":" + req.MessageId
+	}
+
+	sum := sha1.Sum(req.Body)
+	return req.Action + ":" + hex.EncodeToString(sum[:])
+}
+
+//beginSaga resumes the saga of an earlier attempt of req or starts a new one
+func beginSaga(req *Request) (*saga, error) {
+	bucket, err := connectionHandler.GetBucket("Saga")
+	if err != nil {
+		return nil, storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	s := &saga{req: req, bucket: bucket}
+
+	id := sagaId(req)
+	err = bucket.Get(id, &s.record)
+	if err != nil && !connectionHandler.IsNotFound(err) {
+		return nil, storageError(err, "Failed to get saga %q", id)
+	}
+
+	if err == nil && s.record.Status == sagaRunning {
+		log.Printf("resuming saga %q after %v", id, s.record.Completed)
+	} else {
+		s.record = dataType.Saga{Id: id, Action: req.Action, Status: sagaRunning}
+	}
+
+	if s.record.State == nil {
+		s.record.State = make(map[string]string)
+	}
+
+	return s, nil
+}
+
+func (s *saga) save() error {
+	s.record.Time = time.Now().Unix()
+
+	//a saga left half done is kept until an operator removes it
+	expiry := sagaExpiry
+	if s.record.Status == sagaCompensationFailed {
+		expiry = 0
+	}
+
+	err := s.bucket.Set(s.record.Id, expiry, s.record)
+	if err != nil {
+		return storageError(err, "Failed to save saga %q", s.record.Id)
+	}
+
+	return nil
+}
+
+//step runs action unless an earlier attempt completed it, compensate may be nil
+//the write of action and the save of the step are not atomic, when the save fails the next
+//attempt runs action again. so action must be safe to repeat, and anything compensate or a
+//later step relies on has to be recorded by an earlier step, before the write changes it
+func (s *saga) step(name string, action, compensate func() error) error {
+	if !containItem(s.record.Completed, name) {
+		err := action()
+		if err != nil {
+			return err
+		}
+
+		s.record.Completed = append(s.record.Completed, name)
+		err = s.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	if compensate != nil {
+		s.compensations = append(s.compensations, compensate)
+	}
+
+	return nil
+}
+
+//get and set keep values steps need across attempts, set values are saved with the next step
+func (s *saga) get(key string) string {
+	return s.record.State[key]
+}
+
+func (s *saga) set(key, value string) {
+	s.record.State[key] = value
+}
+
+//finish drops the record of a completed saga
+//the request is marked processed first, so a crash in between cannot run it a second time
+func (s *saga) finish() error {
+	markProcessed(s.req)
+
+	err := s.bucket.Delete(s.record.Id)
+	if err != nil && !connectionHandler.IsNotFound(err) {
+		log.Printf("failed to delete finished saga %q: %s", s.record.Id, err)
+	}
+
+	return nil
+}
+
+//abort handles the failure of a step and returns the error for the request
+//a transient failure keeps the record for the next attempt, unless there is none
+func (s *saga) abort(err error) error {
+	if isTransient(err) && !s.req.FinalAttempt {
+		return err
+	}
+
+	for i := len(s.compensations) - 1; i >= 0; i-- {
+		compErr := s.compensations[i]()
+		if compErr != nil {
+			//keep what is left for an operator, the request itself has failed either way
+			log.Printf("failed to roll back saga %q: %s", s.record.Id, compErr)
+
+			s.record.Status = sagaCompensationFailed
+			s.record.Error = compErr.Error()
+			if saveErr := s.save(); saveErr != nil {
+				log.Printf("failed to keep saga %q for an operator: %s", s.record.Id, saveErr)
+			}
+
+			return err
+		}
+	}
+
+	delErr := s.bucket.Delete(s.record.Id)
+	if delErr != nil && !connectionHandler.IsNotFound(delErr) {
+		log.Printf("failed to delete rolled back saga %q: %s", s.record.Id, delErr)
+	}
+
+	return err
+}
@@ -0,0 +1,204 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+//faultyStore fails one chosen Set of the Saga bucket, the write of a step then happened
+//but its progress was not saved
+type faultyStore struct {
+	*connectionHandler.MemoryStore
+	failIn int
+}
+
+type faultyBucket struct {
+	connectionHandler.Bucket
+	store *faultyStore
+}
+
+func (s *faultyStore) GetBucket(bucketname string) (connectionHandler.Bucket, error) {
+	bucket, err := s.MemoryStore.GetBucket(bucketname)
+	if err != nil || bucketname != "Saga" {
+		return bucket, err
+	}
+
+	return faultyBucket{Bucket: bucket, store: s}, nil
+}
+
+func (b faultyBucket) Set(key string, exp int, v interface{}) error {
+	if b.store.failIn > 0 {
+		b.store.failIn--
+		if b.store.failIn == 0 {
+			return errors.New("injected failure")
+		}
+	}
+
+	return b.Bucket.Set(key, exp, v)
+}
+
+func useFaultyStore(t *testing.T) *faultyStore {
+	store := &faultyStore{MemoryStore: connectionHandler.NewMemoryStore()}
+	connectionHandler.UseStore(store)
+	return store
+}
+
+//processAfterFailure expects the first attempt to fail transiently and the retry to succeed
+func processAfterFailure(t *testing.T, body string) {
+	err := ProcessMessage([]byte(body))
+	if err == nil || !isTransient(err) {
+		t.Fatalf("first attempt: err = %v, want a transient failure", err)
+	}
+
+	process(t, body)
+}
+
+func TestNewThreadRetriesAfterFailedSave(t *testing.T) {
+	store := useFaultyStore(t)
+	registerFriends(t, "alice", "bob")
+
+	//saves: threadId, writeThread
+	store.failIn = 2
+	processAfterFailure(t, `{"action":"newThread","request_id":"t1","author":"alice","content":"hello","pub_date":100}`)
+
+	sameList(t, "alice writeThread", getUser(t, "alice").WriteThread, "1")
+	sameList(t, "bob unreadThread", getUser(t, "bob").UnreadThread, "1")
+}
+
+func TestCommentAddRetriesAfterFailedSave(t *testing.T) {
+	store := useFaultyStore(t)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	//saves: commentId, writeComment
+	store.failIn = 2
+	processAfterFailure(t, `{"action":"commentAdd","request_id":"c1","thread_id":"1","author":"bob","content":"hi"}`)
+
+	sameList(t, "thread comments", getThread(t, "1").Comment, "1")
+	sameList(t, "bob writeComment", getUser(t, "bob").WriteComment, "1")
+}
+
+func TestThreadEditRetriesAfterFailedSave(t *testing.T) {
+	store := useFaultyStore(t)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"userRegister","Id":"carol"}`)
+	process(t, `{"action":"friendAdd","user":"carol","friendList":["alice"]}`)
+	process(t, `{"action":"newThread","author":"alice","content":"hello","is_public":"false","pub_date":100}`)
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread)
+
+	//saves: visibility, editThread
+	store.failIn = 2
+	processAfterFailure(t, `{"action":"threadEdit","request_id":"e1","thread_id":"1","user":"alice","is_public":"true"}`)
+
+	thread := getThread(t, "1")
+	if !thread.IsPublic() || len(thread.History) != 1 {
+		t.Fatalf("thread = %+v, want public with one revision", thread)
+	}
+	sameList(t, "carol unreadThread", getUser(t, "carol").UnreadThread, "1")
+}
+
+func TestThreadLikeRollsBackAfterFailedSave(t *testing.T) {
+	store := useFaultyStore(t)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	//saves: threadBefore, thread
+	store.failIn = 2
+	err := ProcessMessage([]byte(`{"action":"threadLike","request_id":"l1","thread_id":"1","user":"bob"}`))
+	if err == nil {
+		t.Fatal("first attempt succeeded")
+	}
+
+	//bob leaves, so the retry fails for good and has to undo the like of the first attempt
+	userBucket, _ := connectionHandler.GetBucket("User")
+	userBucket.Delete("bob")
+
+	processKind(t, `{"action":"threadLike","request_id":"l1","thread_id":"1","user":"bob"}`, NotFound)
+	sameList(t, "thread likes", getThread(t, "1").Like)
+}
+
+//brokenStore fails every Cas of the chosen buckets, like a node that is down for longer than the retries
+type brokenStore struct {
+	*connectionHandler.MemoryStore
+	broken map[string]bool
+}
+
+type brokenBucket struct {
+	connectionHandler.Bucket
+}
+
+func (s *brokenStore) GetBucket(bucketname string) (connectionHandler.Bucket, error) {
+	bucket, err := s.MemoryStore.GetBucket(bucketname)
+	if err != nil || !s.broken[bucketname] {
+		return bucket, err
+	}
+
+	return brokenBucket{bucket}, nil
+}
+
+func (b brokenBucket) Cas(key string, exp int, cas uint64, v interface{}) (uint64, error) {
+	return 0, errors.New("injected failure")
+}
+
+//attempt runs body the way a worker does, final when the broker will not deliver it again
+func attempt(t *testing.T, body string, final bool) error {
+	req, entry, err := decodeDelivery(amqp.Delivery{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retries := *inlineRetries
+	*inlineRetries = 0
+	defer func() { *inlineRetries = retries }()
+
+	return retryInPlace(entry, req, final)
+}
+
+func TestSagaGivesUpOnLastAttempt(t *testing.T) {
+	store := &brokenStore{MemoryStore: connectionHandler.NewMemoryStore(), broken: map[string]bool{}}
+	connectionHandler.UseStore(store)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	store.broken["User"] = true
+	body := `{"action":"commentAdd","request_id":"c1","thread_id":"1","author":"bob","content":"hi"}`
+
+	//an attempt that will be retried keeps what it did for the next one
+	if err := attempt(t, body, false); !isTransient(err) {
+		t.Fatalf("err = %v, want transient", err)
+	}
+	sameList(t, "thread comments", getThread(t, "1").Comment, "1")
+	getDoc(t, "Saga", "commentAdd:c1", &dataType.Saga{})
+
+	//the last one rolls back before the delivery is dead-lettered
+	if err := attempt(t, body, true); !isTransient(err) {
+		t.Fatalf("err = %v, want transient", err)
+	}
+	sameList(t, "thread comments", getThread(t, "1").Comment)
+	missingDoc(t, "Comment", "1")
+	missingDoc(t, "Saga", "commentAdd:c1")
+}
+
+func TestSagaKeptWhenRollbackFails(t *testing.T) {
+	store := &brokenStore{MemoryStore: connectionHandler.NewMemoryStore(), broken: map[string]bool{}}
+	connectionHandler.UseStore(store)
+	registerFriends(t, "alice", "bob")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+
+	body := `{"action":"commentAdd","request_id":"c1","thread_id":"1","author":"bob","content":"hi"}`
+	store.broken["User"] = true
+	attempt(t, body, false)
+
+	//the thread cannot be unlinked anymore either
+	store.broken["Thread"] = true
+	attempt(t, body, true)
+
+	var record dataType.Saga
+	getDoc(t, "Saga", "commentAdd:c1", &record)
+	if record.Status != sagaCompensationFailed || record.Error == "" {
+		t.Fatalf("saga = %+v, want it kept as %s", record, sagaCompensationFailed)
+	}
+}
@@ -0,0 +1,143 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"log"
+)
+
+func init() {
+	RegisterAction(`threadDelete`, func() interface{} { return &dataType.ThreadRequest{} }, deleteThread)
+}
+
+//deleteThread tombstones the thread, removes its comments and every reference users hold to it,
+//then removes the thread itself. a retry finds the tombstone and finishes the cleanup
+func deleteThread(req *Request) error {
+	request := req.Payload.(*dataType.ThreadRequest)
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	commentBucket, err := connectionHandler.GetBucket("Comment")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	timelineBucket, err := connectionHandler.GetBucket("Timeline")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var thread dataType.Thread
+	err = updateDocument(req.Action, threadBucket, request.Thread_id, &thread, func() error {
+		if thread.Author != request.User {
+			return newRequestError(Forbidden, "%q is not the author of thread %s", request.User, request.Thread_id)
+		}
+		thread.Deleted = true
+		return nil
+	})
+	//already gone, nothing left to clean up
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	//everyone who may hold the thread id: the author, friends it was fanned out to, readers and likers
+	var author dataType.User
+	err = userBucket.Get(thread.Author, &author)
+	if err != nil && !connectionHandler.IsNotFound(err) {
+		return storageError(err, "Failed to get author of thread %s", thread.Id)
+	}
+
+	users := []string{thread.Author}
+	for _, list := range [][]string{author.Friends, thread.Audience, thread.Reader, thread.Like} {
+		for _, user_id := range list {
+			users = appendUnique(users, user_id)
+		}
+	}
+
+	for _, comment_id := range thread.Comment {
+		err = deleteComment(req.Action, commentBucket, userBucket, comment_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, user_id := range users {
+		err = scrubUser(req.Action, userBucket, user_id, func(user *dataType.User) {
+			user.WriteThread = removeItem(user.WriteThread, thread.Id)
+			user.LikeThread = removeItem(user.LikeThread, thread.Id)
+			user.UnreadThread = removeItem(user.UnreadThread, thread.Id)
+			user.ReadedThread = removeItem(user.ReadedThread, thread.Id)
+		})
+		if err == nil {
+			err = removeFromTimeline(req.Action, timelineBucket, user_id, thread.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if thread.Pull {
+		err = removeFromTimeline(req.Action, timelineBucket, postsKey(thread.Author), thread.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return deleteDocument(threadBucket, thread.Id)
+}
+
+//deleteComment removes a comment of a deleted thread and the ids its author and likers keep
+func deleteComment(action string, commentBucket, userBucket connectionHandler.Bucket, comment_id string) error {
+	var comment dataType.Comment
+	err := commentBucket.Get(comment_id, &comment)
+	if connectionHandler.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return storageError(err, "Failed to get comment %s", comment_id)
+	}
+
+	err = scrubUser(action, userBucket, comment.Author, func(user *dataType.User) {
+		user.WriteComment = removeItem(user.WriteComment, comment_id)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user_id := range comment.Like {
+		err = scrubUser(action, userBucket, user_id, func(user *dataType.User) {
+			user.LikeComment = removeItem(user.LikeComment, comment_id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return deleteDocument(commentBucket, comment_id)
+}
+
+//scrubUser applies scrub to a user document, users that no longer exist are skipped
+func scrubUser(action string, userBucket connectionHandler.Bucket, user_id string, scrub func(user *dataType.User)) error {
+	var user dataType.User
+	err := updateDocument(action, userBucket, user_id, &user, func() error {
+		scrub(&user)
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		log.Printf("skipping cleanup of missing user %q", user_id)
+		return nil
+	}
+
+	return err
+}
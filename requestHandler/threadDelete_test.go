@@ -0,0 +1,87 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"testing"
+)
+
+//threadWithReferences posts thread 1 of alice that bob commented on and liked and carol read,
+//carol likes the comment. thread 2 is left alone
+func threadWithReferences(t *testing.T) {
+	registerFriends(t, "alice", "bob", "carol")
+	process(t, `{"action":"newThread","author":"alice","content":"hello","pub_date":100}`)
+	process(t, `{"action":"newThread","author":"alice","content":"again","pub_date":200}`)
+
+	process(t, `{"action":"commentAdd","thread_id":"1","author":"bob","content":"hi"}`)
+	process(t, `{"action":"threadLike","thread_id":"1","user":"bob"}`)
+	process(t, `{"action":"commentLike","comment_id":"1","user":"carol"}`)
+	process(t, `{"action":"threadRead","thread_id":"1","user":"carol"}`)
+}
+
+//threadGone checks that nothing refers to thread 1 anymore
+func threadGone(t *testing.T) {
+	missingDoc(t, "Thread", "1")
+	missingDoc(t, "Comment", "1")
+
+	alice, bob, carol := getUser(t, "alice"), getUser(t, "bob"), getUser(t, "carol")
+	sameList(t, "alice writeThread", alice.WriteThread, "2")
+	sameList(t, "bob writeComment", bob.WriteComment)
+	sameList(t, "bob likeThread", bob.LikeThread)
+	sameList(t, "bob unreadThread", bob.UnreadThread, "2")
+	sameList(t, "carol likeComment", carol.LikeComment)
+	sameList(t, "carol readedThread", carol.ReadedThread)
+	sameList(t, "carol unreadThread", carol.UnreadThread, "2")
+
+	for _, user_id := range []string{"bob", "carol"} {
+		page := readPage(t, `{"action":"timelineRead","user":"`+user_id+`"}`)
+		sameList(t, user_id+" timeline", pageIds(page), "2")
+	}
+}
+
+func TestThreadDelete(t *testing.T) {
+	useMemoryStore(t)
+	threadWithReferences(t)
+
+	process(t, `{"action":"threadDelete","thread_id":"1","user":"alice"}`)
+	threadGone(t)
+
+	//a redelivery finds nothing left to do
+	process(t, `{"action":"threadDelete","thread_id":"1","user":"alice"}`)
+}
+
+func TestThreadDeleteByOthers(t *testing.T) {
+	useMemoryStore(t)
+	threadWithReferences(t)
+
+	processKind(t, `{"action":"threadDelete","thread_id":"1","user":"bob"}`, Forbidden)
+
+	thread := getThread(t, "1")
+	if thread.Deleted {
+		t.Fatal("thread tombstoned by a user who is not its author")
+	}
+	sameList(t, "thread comments", thread.Comment, "1")
+	sameList(t, "bob likeThread", getUser(t, "bob").LikeThread, "1")
+	sameList(t, "carol readedThread", getUser(t, "carol").ReadedThread, "1")
+	sameList(t, "carol likeComment", getUser(t, "carol").LikeComment, "1")
+}
+
+func TestThreadDeleteResumesCleanup(t *testing.T) {
+	store := &brokenStore{MemoryStore: connectionHandler.NewMemoryStore(), broken: map[string]bool{}}
+	connectionHandler.UseStore(store)
+	threadWithReferences(t)
+
+	//the timelines come last, comments and user lists are cleaned up by then
+	store.broken["Timeline"] = true
+	err := ProcessMessage([]byte(`{"action":"threadDelete","thread_id":"1","user":"alice"}`))
+	if !isTransient(err) {
+		t.Fatalf("err = %v, want a transient failure", err)
+	}
+	if !getThread(t, "1").Deleted {
+		t.Fatal("thread not tombstoned")
+	}
+	missingDoc(t, "Comment", "1")
+
+	store.broken["Timeline"] = false
+	process(t, `{"action":"threadDelete","thread_id":"1","user":"alice"}`)
+	threadGone(t)
+}
@@ -0,0 +1,151 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"strconv"
+)
+
+func init() {
+	RegisterAction(`threadEdit`, func() interface{} { return &dataType.ThreadRequest{} }, editThread)
+}
+
+//editThread updates the fields given by the author and keeps the previous version in the history
+//when the visibility changes, the fan-out policy is run again and users who gain or
+//lose access get the thread added or removed by fan-out batches
+func editThread(req *Request) error {
+	request := req.Payload.(*dataType.ThreadRequest)
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	s, err := beginSaga(req)
+	if err != nil {
+		return err
+	}
+
+	//the visibility before the edit is saved before the thread changes, an attempt that
+	//repeats the edit after a failed save finds the new visibility on the thread already
+	var thread dataType.Thread
+	err = s.step("visibility", func() error {
+		err := threadBucket.Get(request.Thread_id, &thread)
+		if err != nil {
+			return storageError(err, "Failed to get thread %s", request.Thread_id)
+		}
+		if thread.Deleted {
+			return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
+		}
+		if thread.Author != request.User {
+			return newRequestError(Forbidden, "%q is not the author of thread %s", request.User, request.Thread_id)
+		}
+
+		s.set("wasPublic", strconv.FormatBool(thread.IsPublic()))
+		return nil
+	}, nil)
+	if err != nil {
+		return s.abort(err)
+	}
+
+	err = s.step("editThread", func() error {
+		return updateDocument(req.Action, threadBucket, request.Thread_id, &thread, func() error {
+			if thread.Deleted {
+				return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
+			}
+			if thread.Author != request.User {
+				return newRequestError(Forbidden, "%q is not the author of thread %s", request.User, request.Thread_id)
+			}
+
+			revision := dataType.ThreadRevision{
+				Content:  thread.Content,
+				Image:    thread.Image,
+				Public:   thread.Public,
+				EditTime: requestTime(request.Time),
+			}
+
+			if request.Content != nil {
+				thread.Content = *request.Content
+			}
+			if request.Image != nil {
+				thread.Image = *request.Image
+			}
+			if request.Public != nil {
+				thread.Public = *request.Public
+			}
+
+			s.set("isPublic", strconv.FormatBool(thread.IsPublic()))
+
+			if thread.Content == "" && thread.Image == "" {
+				return newRequestError(Invalid, "thread %s would have neither content nor image_url", thread.Id)
+			}
+
+			if thread.Content != revision.Content || thread.Image != revision.Image || thread.Public != revision.Public {
+				thread.History = append(thread.History, revision)
+			}
+
+			return nil
+		})
+	}, nil)
+	if err != nil {
+		return s.abort(err)
+	}
+
+	if s.get("wasPublic") == s.get("isPublic") {
+		return s.finish()
+	}
+
+	var author dataType.User
+	err = userBucket.Get(request.User, &author)
+	if err != nil {
+		return s.abort(storageError(err, "Failed to get author of thread %s", request.Thread_id))
+	}
+
+	err = threadBucket.Get(request.Thread_id, &thread)
+	if err != nil {
+		return s.abort(storageError(err, "Failed to get thread %s", request.Thread_id))
+	}
+
+	//readers of a pull thread are checked when they read it
+	if thread.Pull {
+		err = setPostVisibility(req.Action, thread.Author, thread.Id, thread.IsPublic())
+		if err != nil {
+			return s.abort(err)
+		}
+		return s.finish()
+	}
+
+	policy := currentFanoutPolicy()
+	//threads older than the audience field were delivered to the candidates of their visibility
+	oldAudience := thread.Audience
+	if oldAudience == nil {
+		oldAudience = policy.Candidates(&author, &dataType.Thread{Public: s.get("wasPublic")})
+	}
+	candidates := policy.Candidates(&author, &dataType.Thread{Public: s.get("isPublic")})
+
+	oldSet, candidateSet := itemSet(oldAudience), itemSet(candidates)
+
+	var added, revoked []string
+	for _, reader_id := range candidates {
+		if !oldSet[reader_id] {
+			added = append(added, reader_id)
+		}
+	}
+	for _, reader_id := range oldAudience {
+		if !candidateSet[reader_id] {
+			revoked = append(revoked, reader_id)
+		}
+	}
+
+	err = startFanout(s, threadBucket, request.Thread_id, added, revoked)
+	if err != nil {
+		return s.abort(err)
+	}
+
+	return s.finish()
+}
@@ -0,0 +1,119 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+)
+
+func init() {
+	RegisterAction(`threadRead`, func() interface{} { return &dataType.ThreadRequest{} }, readThread)
+	RegisterAction(`threadReadAll`, func() interface{} { return &dataType.UserRequest{} }, readAllThreads)
+}
+
+//readThread marks one thread as read by the user
+//the thread is updated first, a retry after a failed user update finds the reader already there
+func readThread(req *Request) error {
+	request := req.Payload.(*dataType.ThreadRequest)
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	exist, err := addReader(req.Action, threadBucket, request.Thread_id, request.User)
+	if err != nil {
+		return err
+	}
+
+	var user dataType.User
+	return updateReadLists(req.Action, userBucket, request.User, &user, func() {
+		markRead(&user, request.Thread_id, exist)
+	})
+}
+
+//readAllThreads marks every thread unread at the time of the request as read
+//threads delivered while it runs stay unread
+func readAllThreads(req *Request) error {
+	request := req.Payload.(*dataType.UserRequest)
+
+	threadBucket, err := connectionHandler.GetBucket("Thread")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	userBucket, err := connectionHandler.GetBucket("User")
+	if err != nil {
+		return storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var user dataType.User
+	err = userBucket.Get(request.User, &user)
+	if err != nil {
+		return storageError(err, "Failed to get user %q", request.User)
+	}
+
+	unread := user.UnreadThread
+	exist := make(map[string]bool, len(unread))
+	for _, thread_id := range unread {
+		exist[thread_id], err = addReader(req.Action, threadBucket, thread_id, request.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	return updateReadLists(req.Action, userBucket, request.User, &user, func() {
+		for _, thread_id := range unread {
+			markRead(&user, thread_id, exist[thread_id])
+		}
+	})
+}
+
+//addReader records user_id as a reader of the thread, it reports false for a deleted thread
+func addReader(action string, threadBucket connectionHandler.Bucket, thread_id, user_id string) (bool, error) {
+	var thread dataType.Thread
+	err := updateDocument(action, threadBucket, thread_id, &thread, func() error {
+		if thread.Deleted {
+			return newRequestError(NotFound, "thread %s is being deleted", thread.Id)
+		}
+		thread.Reader = appendUnique(thread.Reader, user_id)
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//markRead moves the thread from the unread to the readed list of user
+//a deleted thread is only dropped from the unread list
+func markRead(user *dataType.User, thread_id string, exist bool) {
+	user.UnreadThread = removeItem(user.UnreadThread, thread_id)
+	if exist {
+		user.ReadedThread = appendUnique(user.ReadedThread, thread_id)
+	}
+}
+
+//updateReadLists runs mark on user and keeps its lists within the caps
+func updateReadLists(action string, userBucket connectionHandler.Bucket, user_id string, user *dataType.User, mark func()) error {
+	var unreadTrimmed, readedTrimmed int
+	err := updateDocument(action, userBucket, user_id, user, func() error {
+		mark()
+		unreadTrimmed, readedTrimmed = capThreadLists(user)
+		return nil
+	})
+	if err == nil {
+		countTrim("unread:cap", unreadTrimmed)
+		countTrim("readed:cap", readedTrimmed)
+	}
+
+	return err
+}
@@ -0,0 +1,54 @@
+package requestHandler
+
+import "testing"
+
+func TestThreadRead(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	postThreads(t, "alice", 100, 200)
+
+	read := `{"action":"threadRead","thread_id":"1","user":"bob"}`
+	process(t, read)
+	//a redelivery changes nothing
+	process(t, read)
+
+	bob := getUser(t, "bob")
+	sameList(t, "bob unreadThread", bob.UnreadThread, "2")
+	sameList(t, "bob readedThread", bob.ReadedThread, "1")
+	sameList(t, "thread readers", getThread(t, "1").Reader, "bob")
+}
+
+func TestThreadReadAll(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	postThreads(t, "alice", 100, 200, 300)
+
+	readAll := `{"action":"threadReadAll","user":"bob"}`
+	process(t, readAll)
+	process(t, readAll)
+
+	bob := getUser(t, "bob")
+	sameList(t, "bob unreadThread", bob.UnreadThread)
+	sameList(t, "bob readedThread", bob.ReadedThread, "1", "2", "3")
+	for _, thread_id := range []string{"1", "2", "3"} {
+		sameList(t, "thread "+thread_id+" readers", getThread(t, thread_id).Reader, "bob")
+	}
+}
+
+//a thread being deleted leaves the unread list without being recorded as read
+func TestThreadReadDeleted(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	postThreads(t, "alice", 100, 200)
+
+	thread := getThread(t, "1")
+	thread.Deleted = true
+	setDoc(t, "Thread", "1", thread)
+
+	process(t, `{"action":"threadReadAll","user":"bob"}`)
+
+	bob := getUser(t, "bob")
+	sameList(t, "bob unreadThread", bob.UnreadThread)
+	sameList(t, "bob readedThread", bob.ReadedThread, "2")
+	sameList(t, "thread readers", getThread(t, "1").Reader)
+}
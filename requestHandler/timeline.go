@@ -0,0 +1,198 @@
+package requestHandler
+
+import (
+	"../connectionHandler"
+	"../dataType"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterAction(`timelineRead`, func() interface{} { return &dataType.TimelineRequest{} }, readTimeline)
+}
+
+var (
+	timelineLength = flag.Int("timelineLength", 500, "threads kept in the timeline of each user, older ones are dropped")
+	timelinePage   = flag.Int("timelinePage", 20, "threads in a timeline page when the caller gives no limit")
+)
+
+//entryBefore reports whether a comes before b in a timeline, newest first and
+//the later thread first among threads of the same pub_date
+func entryBefore(a, b dataType.TimelineEntry) bool {
+	if a.Time != b.Time {
+		return a.Time > b.Time
+	}
+
+	return threadIdLess(b.Thread_id, a.Thread_id)
+}
+
+//threadIdLess orders thread ids numerically, which is the order they were created in
+func threadIdLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
+
+//insertEntry adds entry in order and drops what is beyond -timelineLength
+func insertEntry(timeline *dataType.Timeline, entry dataType.TimelineEntry) {
+	for _, existing := range timeline.Entries {
+		if existing.Thread_id == entry.Thread_id {
+			return
+		}
+	}
+
+	index := len(timeline.Entries)
+	for i, existing := range timeline.Entries {
+		if entryBefore(entry, existing) {
+			index = i
+			break
+		}
+	}
+
+	entries := append(timeline.Entries, dataType.TimelineEntry{})
+	copy(entries[index+1:], entries[index:])
+	entries[index] = entry
+
+	if *timelineLength > 0 && len(entries) > *timelineLength {
+		entries = entries[:*timelineLength]
+	}
+	timeline.Entries = entries
+}
+
+//addToTimeline puts the thread in the timeline stored under key, the timeline is created on first use
+func addToTimeline(action string, timelineBucket connectionHandler.Bucket, key string, entry dataType.TimelineEntry) error {
+	var timeline dataType.Timeline
+	return upsertDocument(action, timelineBucket, key, &timeline, dataType.Timeline{User: key}, func() error {
+		insertEntry(&timeline, entry)
+		return nil
+	})
+}
+
+//removeFromTimeline takes the thread out of the timeline stored under key
+func removeFromTimeline(action string, timelineBucket connectionHandler.Bucket, key, thread_id string) error {
+	var timeline dataType.Timeline
+	err := updateDocument(action, timelineBucket, key, &timeline, func() error {
+		for i, entry := range timeline.Entries {
+			if entry.Thread_id == thread_id {
+				timeline.Entries = append(timeline.Entries[:i], timeline.Entries[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	if ErrorKindOf(err) == NotFound {
+		return nil
+	}
+
+	return err
+}
+
+//cursors are the position after the last entry of a page, so entries added meanwhile
+//do not shift the following pages
+func encodeCursor(entry dataType.TimelineEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(entry.Time, 10) + ":" + entry.Thread_id))
+}
+
+func decodeCursor(cursor string) (dataType.TimelineEntry, error) {
+	var entry dataType.TimelineEntry
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return entry, newRequestError(Invalid, "malformed cursor")
+	}
+
+	fields := strings.SplitN(string(raw), ":", 2)
+	if len(fields) != 2 {
+		return entry, newRequestError(Invalid, "malformed cursor")
+	}
+
+	entry.Time, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return entry, newRequestError(Invalid, "malformed cursor")
+	}
+	entry.Thread_id = fields[1]
+
+	return entry, nil
+}
+
+//ReadTimeline returns up to limit threads of the timeline of user_id after cursor, with the
+//threads of pull authors the user may see merged in
+//an empty cursor starts at the newest thread and an empty Next means there is no more
+func ReadTimeline(user_id, cursor string, limit int) (dataType.TimelinePage, error) {
+	var page dataType.TimelinePage
+
+	if limit < 1 {
+		limit = *timelinePage
+	}
+	if limit > dataType.MaxTimelinePage {
+		limit = dataType.MaxTimelinePage
+	}
+
+	timelineBucket, err := connectionHandler.GetBucket("Timeline")
+	if err != nil {
+		return page, storageError(err, "Failed to get bucket from couchbase")
+	}
+
+	var timeline dataType.Timeline
+	err = timelineBucket.Get(user_id, &timeline)
+	if err != nil && !connectionHandler.IsNotFound(err) {
+		return page, storageError(err, "Failed to get timeline of %q", user_id)
+	}
+
+	//threads of pull authors were never pushed, they are merged in here
+	pulled, err := pulledEntries(timelineBucket, user_id)
+	if err != nil {
+		return page, err
+	}
+	entries := mergeEntries(timeline.Entries, pulled)
+
+	start := 0
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+
+		start = len(entries)
+		for i, entry := range entries {
+			if entryBefore(after, entry) {
+				start = i
+				break
+			}
+		}
+	}
+
+	end := start + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	page.Entries = entries[start:end]
+	if end < len(entries) {
+		page.Next = encodeCursor(page.Entries[len(page.Entries)-1])
+	}
+
+	return page, nil
+}
+
+//readTimeline sends a page of the timeline back as the data of the reply
+func readTimeline(req *Request) error {
+	request := req.Payload.(*dataType.TimelineRequest)
+
+	page, err := ReadTimeline(request.User, request.Cursor, request.Limit)
+	if err != nil {
+		return err
+	}
+
+	req.Data, err = json.Marshal(page)
+	if err != nil {
+		return newRequestError(BadPayload, "Failed to encode timeline page (%s)", err)
+	}
+
+	return nil
+}
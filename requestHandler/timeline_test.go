@@ -0,0 +1,110 @@
+package requestHandler
+
+import (
+	"../dataType"
+	"encoding/json"
+	"github.com/streadway/amqp"
+	"strconv"
+	"testing"
+)
+
+//readPage runs timelineRead like the consumer does and decodes the data of its reply
+func readPage(t *testing.T, body string) dataType.TimelinePage {
+	req, entry, err := decodeDelivery(amqp.Delivery{Body: []byte(body)})
+	if err == nil {
+		err = runRequest(entry, req)
+	}
+	if err != nil {
+		t.Fatalf("processing %s: %s", body, err)
+	}
+
+	var page dataType.TimelinePage
+	if err := json.Unmarshal(req.Data, &page); err != nil {
+		t.Fatalf("reply data %s: %s", req.Data, err)
+	}
+
+	return page
+}
+
+func postThreads(t *testing.T, author string, dates ...int64) {
+	for _, date := range dates {
+		process(t, `{"action":"newThread","author":"`+author+`","content":"hi","pub_date":`+strconv.FormatInt(date, 10)+`}`)
+	}
+}
+
+func pageIds(page dataType.TimelinePage) []string {
+	var ids []string
+	for _, entry := range page.Entries {
+		ids = append(ids, entry.Thread_id)
+	}
+	return ids
+}
+
+func TestTimelinePaging(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	postThreads(t, "alice", 100, 300, 200, 500, 400)
+
+	page := readPage(t, `{"action":"timelineRead","user":"bob","limit":2}`)
+	sameList(t, "first page", pageIds(page), "4", "5")
+
+	//a newer thread does not shift the pages after the cursor
+	postThreads(t, "alice", 600)
+
+	page = readPage(t, `{"action":"timelineRead","user":"bob","limit":2,"cursor":"`+page.Next+`"}`)
+	sameList(t, "second page", pageIds(page), "2", "3")
+
+	page = readPage(t, `{"action":"timelineRead","user":"bob","limit":2,"cursor":"`+page.Next+`"}`)
+	sameList(t, "last page", pageIds(page), "1")
+	if page.Next != "" {
+		t.Fatalf("last page has next cursor %q", page.Next)
+	}
+
+	page = readPage(t, `{"action":"timelineRead","user":"bob"}`)
+	sameList(t, "default page", pageIds(page), "6", "4", "5", "2", "3", "1")
+}
+
+func TestTimelineReadEmptyAndInvalid(t *testing.T) {
+	useMemoryStore(t)
+	process(t, `{"action":"userRegister","Id":"alice"}`)
+
+	if page := readPage(t, `{"action":"timelineRead","user":"alice"}`); len(page.Entries) != 0 || page.Next != "" {
+		t.Fatalf("page = %+v, want empty", page)
+	}
+
+	processKind(t, `{"action":"timelineRead","user":"alice","cursor":"a+b/"}`, Invalid)
+	processKind(t, `{"action":"timelineRead","user":"alice","cursor":"bm9wZQ"}`, Invalid)
+	processKind(t, `{"action":"timelineRead","user":"alice","limit":1000}`, Invalid)
+}
+
+//a redelivered read gets the page of the original reply
+func TestTimelineReadDuplicate(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+	postThreads(t, "alice", 100)
+
+	body := `{"action":"timelineRead","request_id":"r1","user":"bob"}`
+	readPage(t, body)
+	postThreads(t, "alice", 200)
+
+	sameList(t, "duplicate page", pageIds(readPage(t, body)), "1")
+}
+
+//pulled threads are filtered per reader by the policy, like pushed ones
+func TestTimelinePullsVisibleThreads(t *testing.T) {
+	threshold := *pullThreshold
+	*pullThreshold = 1
+	defer func() { *pullThreshold = threshold }()
+
+	visibilityUsers(t)
+	process(t, `{"action":"newThread","author":"alice","content":"hi","is_public":"true","pub_date":100}`)
+	process(t, `{"action":"newThread","author":"alice","content":"hi","is_public":"false","pub_date":200}`)
+	if !getThread(t, "1").Pull {
+		t.Fatal("thread 1 was pushed")
+	}
+
+	sameList(t, "bob timeline", pageIds(readPage(t, `{"action":"timelineRead","user":"bob"}`)), "2", "1")
+	sameList(t, "carol timeline", pageIds(readPage(t, `{"action":"timelineRead","user":"carol"}`)), "1")
+	sameList(t, "dave timeline", pageIds(readPage(t, `{"action":"timelineRead","user":"dave"}`)))
+	sameList(t, "erin timeline", pageIds(readPage(t, `{"action":"timelineRead","user":"erin"}`)))
+}
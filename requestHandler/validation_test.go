@@ -0,0 +1,56 @@
+package requestHandler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInvalidRequests(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	long := strings.Repeat("x", 2001)
+	for _, body := range []string{
+		`{"action":"userRegister","Id":"not a valid id"}`,
+		`{"action":"newThread","author":"alice"}`,
+		`{"action":"newThread","author":"alice","content":"` + long + `"}`,
+		`{"action":"newThread","author":"alice","content":"hi","is_public":"maybe"}`,
+		`{"action":"newThread","author":"alice","content":"hi","likes":["bob"]}`,
+		`{"action":"newThread","author":"alice","content":"hi","audience":["mallory"]}`,
+		`{"action":"newThread","author":"alice","content":"hi","deleted":true}`,
+		`{"action":"newThread","author":"alice","content":"hi","pull":true}`,
+		`{"action":"newThread","author":"alice","content":"hi","fanout":{"round":"x"}}`,
+		`{"action":"commentAdd","thread_id":"x1","author":"bob","content":"hi"}`,
+		`{"action":"commentAdd","thread_id":"1","author":"bob"}`,
+		`{"action":"friendAdd","user":"alice","friendList":[]}`,
+		`{"action":"friendAdd","user":"alice","friendList":["alice"]}`,
+		`{"action":"threadEdit","thread_id":"1","user":"alice"}`,
+		`{"action":"threadEdit","thread_id":"1","user":"alice","is_public":"maybe"}`,
+		`{"action":"commentEdit","comment_id":"1","user":"bob"}`,
+	} {
+		processKind(t, body, Invalid)
+	}
+
+	//nothing was written by the rejected requests
+	missingDoc(t, "Thread", "1")
+}
+
+func TestBadPayloads(t *testing.T) {
+	useMemoryStore(t)
+
+	for _, body := range []string{
+		`not json`,
+		`{"action":"noSuchAction"}`,
+		`{"action":"friendAdd","user":"alice","friendList":"bob"}`,
+	} {
+		processKind(t, body, BadPayload)
+	}
+}
+
+//validation rules depend on the action, threadReadAll must not need a friendList
+func TestValidationPerAction(t *testing.T) {
+	useMemoryStore(t)
+	registerFriends(t, "alice", "bob")
+
+	process(t, `{"action":"threadReadAll","user":"alice"}`)
+}